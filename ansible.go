@@ -1,57 +1,267 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"html/template"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/koding/vagrantutil"
 )
 
 const ansiblesh = `
-apt && apt update && apt install -y ansible
-yum && yum install -y ansible
+if command -v apt-get >/dev/null; then apt-get update && apt-get install -y ansible; fi
+if command -v yum >/dev/null; then yum install -y ansible; fi
 `
 
-const ansibleHostsTemplate = `{{ $ssh := .SSH }}
-default ansible_host={{ $ssh.Host }} ansible_user={{ $ssh.User }} ansible_port={{ $ssh.Port }} ansible_ssh_private_key_file={{ $ssh.IdentityFile }} ansible_ssh_extra_args='-o StrictHostKeyChecking=no'
-{{ if .Groups }}
-{{ range .Groups -}}
-[{{ . }}]
-default ansible_host={{ $ssh.Host }} ansible_user={{ $ssh.User }} ansible_port={{ $ssh.Port }} ansible_ssh_private_key_file={{ $ssh.IdentityFile }} ansible_ssh_extra_args='-o StrictHostKeyChecking=no'
+// inventory of all running nodes of the project, hosts are named after nodes
+const ansibleInventoryTemplate = `# generated by clover
+{{ range .Hosts -}}
+{{ .Name }} ansible_host={{ .SSH.Host }} {{ if .SSH.Connection }}ansible_connection={{ .SSH.Connection }}{{ else }}ansible_user={{ .SSH.User }} ansible_port={{ .SSH.Port }} ansible_ssh_private_key_file={{ .SSH.IdentityFile }} ansible_ssh_extra_args='{{ .SSHOptions }}'{{ if .SSHPassword }} ansible_password={{ .SSHPassword }}{{ end }}{{ end }}{{ if .PrivateIP }} clover_private_ip={{ .PrivateIP }}{{ end }}
 {{ end }}
+{{- range .Groups }}
+[{{ .Name }}]
+{{ range .Hosts -}}
+{{ . }}
 {{ end }}
-`
+{{- end }}`
+
+// prints the last global ipv4 address of the node
+const privateIPCommand = `(hostname -I 2>/dev/null || ip -4 -o addr show scope global | awk '{split($4, a, "/"); print a[1]}') | tr ' ' '\n' | grep -v '^$' | tail -n 1`
 
 type ansibleHost struct {
-	SSH    sshItems
-	Groups []string
+	Name      string
+	SSH       sshItems
+	PrivateIP string
+	// host key is verified against known hosts of the project, proxy jump
+	SSHOptions string
+	// node.ssh.password quoted for inventory, ansible passes it to ssh with sshpass
+	SSHPassword string
 }
 
-// generates ansible hosts file for node <vagrantdir>/ansiblehosts_<nodename>
-func generateAnsibleHosts(nodeName string, provisioner Provisioner, vagrantDir string) (err error) {
-	if _, statErr := os.Stat(fmt.Sprintf("%s/ansiblehosts_%s", vagrantDir, nodeName)); os.IsNotExist(statErr) {
-		sshConn, _ := getVagrantSSHDetails(vagrantDir, nodeName)
-		if err != nil {
-			return err
+type ansibleGroup struct {
+	Name  string
+	Hosts []string
+}
+
+// returns inventory host of the node, ok is false if node is not running; p.mu guards only
+// the cache, node is reached without it so unreachable node does not block the others; stderr
+// is of the node the host is needed for
+func (p *project) ansibleHost(node *nodeType, stderr io.Writer) (host ansibleHost, ok bool) {
+	p.mu.Lock()
+	host, ok = p.hosts[node.Name]
+	p.mu.Unlock()
+	if ok {
+		return
+	}
+
+	provider, err := p.provider(node)
+	if err != nil {
+		return
+	}
+	if status, err := provider.Status(node); err != nil || status != vagrantutil.Running {
+		return
+	}
+	address, err := provider.Address(node)
+	if err != nil {
+		return
+	}
+	transport, err := p.transport(node)
+	if err != nil {
+		return
+	}
+	out, err := transport.Output(privateIPCommand, stderr)
+	if err != nil {
+		return
+	}
+
+	host = ansibleHost{
+		Name:       node.Name,
+		SSH:        address,
+		PrivateIP:  strings.TrimSpace(string(out)),
+		SSHOptions: strings.Join(sshClientOptions(address, p.knownHosts(node)), " "),
+	}
+	if address.Password != "" {
+		host.SSHPassword = shellQuote(address.Password)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hosts == nil {
+		p.hosts = map[string]ansibleHost{}
+	}
+	p.hosts[node.Name] = host
+	return host, true
+}
+
+// generates <stateDir>/ansible_inventory with all running nodes, groups are collected from ansible provisioners
+func (p *project) generateInventory(stderr io.Writer) (path string, err error) {
+	var inventory struct {
+		Hosts  []ansibleHost
+		Groups []ansibleGroup
+	}
+	groups := map[string][]string{}
+	for i := range p.conf.Nodes {
+		node := &p.conf.Nodes[i]
+		host, ok := p.ansibleHost(node, stderr)
+		if !ok {
+			continue
 		}
+		inventory.Hosts = append(inventory.Hosts, host)
 
-		var ansibleHost ansibleHost
-		ansibleHost.SSH = sshConn
-		ansibleHost.Groups = provisioner.Groups
+		for _, provisioner := range node.Provisioner {
+			for _, group := range provisioner.Groups {
+				// node is the last one in the group if it was already added
+				if len(groups[group]) == 0 || groups[group][len(groups[group])-1] != node.Name {
+					groups[group] = append(groups[group], node.Name)
+				}
+			}
+		}
+	}
+	// NAT address is the same on every node, clover_private_ip is left out rather than wrong
+	privateIPs := map[string]string{}
+	for _, host := range inventory.Hosts {
+		if host.PrivateIP != "" {
+			privateIPs[host.Name] = host.PrivateIP
+		}
+	}
+	unreachable := map[string]bool{}
+	for _, name := range unreachableAddresses(privateIPs) {
+		fmt.Fprintf(stderr, "Skipping clover_private_ip of %s node, its address %s is NAT address or address of other node too\n", name, privateIPs[name])
+		unreachable[name] = true
+	}
+	for i := range inventory.Hosts {
+		if unreachable[inventory.Hosts[i].Name] {
+			inventory.Hosts[i].PrivateIP = ""
+		}
+	}
 
-		var tpl bytes.Buffer
-		vc, err := template.New("hosts").Parse(ansibleHostsTemplate)
-		if err != nil {
-			fmt.Println("Error:", err)
+	for name, hosts := range groups {
+		inventory.Groups = append(inventory.Groups, ansibleGroup{Name: name, Hosts: hosts})
+	}
+	sort.Slice(inventory.Groups, func(i, j int) bool { return inventory.Groups[i].Name < inventory.Groups[j].Name })
+
+	content, err := renderTemplate(ansibleInventoryTemplate, inventory)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// other nodes may be running ansible with current inventory, it may contain ssh passwords
+	path = filepath.Join(p.stateDir, "ansible_inventory")
+	if err = ioutil.WriteFile(path+".tmp", []byte(content), 0600); err != nil {
+		return
+	}
+	err = os.Rename(path+".tmp", path)
+	return
+}
+
+// drops cached inventory host and transport of the node after it was created, reloaded or destroyed
+func (p *project) forgetHost(node *nodeType) {
+	p.mu.Lock()
+	delete(p.hosts, node.Name)
+	p.mu.Unlock()
+	p.closeTransport(node)
+}
+
+// returns path of local file relative to directory of the configuration file
+func (p *project) localPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(p.configDir, path)
+}
+
+// runs ansible-playbook from the host against the node, all nodes if limit is empty
+func runAnsible(p *project, provisioner Provisioner, limit string, stdout, stderr io.Writer) (err error) {
+	if err = execInstalled("ansible-playbook", "--version"); err != nil {
+		return
+	}
+
+	inventory, err := p.generateInventory(stderr)
+	if err != nil {
+		return
+	}
+
+	var cmd *exec.Cmd
+	argsRaw := []string{"-i", inventory, p.localPath(provisioner.Playbook)}
+	if limit != "" {
+		argsRaw = append(argsRaw, "--limit", limit)
+	}
+	if len(provisioner.Extravars) > 0 {
+		var extraVars []string
+		for _, i := range provisioner.Extravars {
+			if strings.HasPrefix(i, "@") {
+				i = "@" + p.localPath(strings.TrimPrefix(i, "@"))
+			}
+			extraVars = append(extraVars, "--extra-vars")
+			extraVars = append(extraVars, i)
 		}
-		err = vc.Execute(&tpl, ansibleHost)
-		ansibleHostsFileContent := tpl.String()
+		argsRaw = append(argsRaw, extraVars...)
+	}
+
+	fmt.Fprintln(stdout, "    ", "ansible-playbook", strings.Join(argsRaw, " "))
+	cmd = exec.Command("ansible-playbook", argsRaw...)
 
-		os.Chdir(vagrantDir)
-		if err := writeFile(fmt.Sprintf("ansiblehosts_%s", nodeName), ansibleHostsFileContent); err != nil {
-			return err
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	return
+}
+
+// runs top level provisioners against all nodes at once
+func provisionAll(p *project) (err error) {
+	p.mu.Lock()
+	state, err := p.loadState()
+	p.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	// top level provisioners depend on nodes too, recreated node has new creation time
+	var instances []string
+	for _, node := range p.conf.Nodes {
+		if nodeState := state.Nodes[node.Name]; nodeState != nil {
+			instances = append(instances, fmt.Sprintf("%s %s", node.Name, nodeState.Timestamps[stageCreated]))
+		}
+	}
+
+	for _, provisioner := range p.conf.Provisioner {
+		if provisioner.Name != "ansible" {
+			return fmt.Errorf("Unsupported top level provisioner %s, only ansible can run against all nodes", provisioner.Name)
+		}
+
+		key := provisionerKey(provisioner)
+		var hash string
+		if provisioner.RunOnce || provisioner.SkipUnchanged {
+			if hash, err = p.provisionerHash(provisioner); err != nil {
+				return
+			}
+			hash = configHash(append([]string{hash}, instances...))
+		}
+		if reason := skipProvisioner(provisioner, state.Provisioners, key, hash); reason != "" {
+			fmt.Printf("Skipping %s provisioner of all nodes, %s\n", provisioner.Name, reason)
+			continue
+		}
+
+		fmt.Println("Provisioning all nodes with ansible:")
+		if err = runAnsible(p, provisioner, "", os.Stdout, os.Stderr); err != nil {
+			return
+		}
+		err = p.saveState(func(state *projectState) bool {
+			if state.Provisioners == nil {
+				state.Provisioners = map[string]string{}
+			}
+			state.Provisioners[key] = hash
+			return true
+		})
+		if err != nil {
+			return
 		}
-		os.Chdir("..")
 	}
 	return
 }
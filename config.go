@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// returns value of the key in yaml mapping, nil if mapping has no such key
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// returns new string scalar positioned at node, generated values point to where they came from
+func (v *validator) scalarAt(node *yaml.Node, value string) *yaml.Node {
+	return v.placeAt(&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}, node)
+}
+
+// appends node named <suite>-<platform> to nodes for every suite and platform combination, suite
+// includes limit platforms it is combined with, excludes are removed from them
+func expandMatrix(v *validator, root *yaml.Node) {
+	platforms, suites := mappingValue(root, "platforms"), mappingValue(root, "suites")
+	if platforms == nil || suites == nil || platforms.Kind != yaml.SequenceNode || suites.Kind != yaml.SequenceNode {
+		return
+	}
+
+	nodes := mappingValue(root, "nodes")
+	if nodes == nil {
+		nodes = v.placeAt(&yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}, suites)
+		root.Content = append(root.Content, v.scalarAt(suites, "nodes"), nodes)
+	} else if nodes.Kind != yaml.SequenceNode {
+		return
+	}
+
+	platformNames := map[string]bool{}
+	for _, platform := range platforms.Content {
+		if name := mappingValue(platform, "name"); name != nil {
+			platformNames[name.Value] = true
+		}
+	}
+
+	for _, suite := range suites.Content {
+		suiteName := mappingValue(suite, "name")
+		if suiteName == nil {
+			continue
+		}
+		included, excluded := map[string]bool{}, map[string]bool{}
+		for _, key := range []string{"includes", "excludes"} {
+			list := mappingValue(suite, key)
+			if list == nil {
+				continue
+			}
+			for _, item := range list.Content {
+				if !platformNames[item.Value] {
+					v.errorAt(item, "platform %s in %s of suite %s is not defined", item.Value, key, suiteName.Value)
+				}
+				if key == "includes" {
+					included[item.Value] = true
+				} else {
+					excluded[item.Value] = true
+				}
+			}
+		}
+
+		for _, platform := range platforms.Content {
+			platformName := mappingValue(platform, "name")
+			if platformName == nil || excluded[platformName.Value] || (len(included) > 0 && !included[platformName.Value]) {
+				continue
+			}
+
+			name := fmt.Sprintf("%s-%s", suiteName.Value, platformName.Value)
+			node := v.placeAt(&yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, suite)
+			node.Content = append(node.Content, v.scalarAt(suiteName, "name"), v.scalarAt(suiteName, name))
+			for _, source := range []*yaml.Node{platform, suite} {
+				for i := 0; i+1 < len(source.Content); i += 2 {
+					switch source.Content[i].Value {
+					case "name", "includes", "excludes":
+					default:
+						node.Content = append(node.Content, source.Content[i], source.Content[i+1])
+					}
+				}
+			}
+			nodes.Content = append(nodes.Content, node)
+		}
+	}
+}
+
+// returns copy of mapping without the key
+func (v *validator) withoutKey(mapping *yaml.Node, key string) *yaml.Node {
+	stripped := v.copyNode(mapping)
+	stripped.Content = nil
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != key {
+			stripped.Content = append(stripped.Content, mapping.Content[i], mapping.Content[i+1])
+		}
+	}
+	return stripped
+}
+
+// returns base deep merged with override: mappings are merged key by key, sequences tagged
+// !append are appended to base sequence, other values of override replace base ones
+func (v *validator) mergeNodes(base, override *yaml.Node) *yaml.Node {
+	if base.Kind == yaml.AliasNode {
+		base = base.Alias
+	}
+	if override.Kind == yaml.AliasNode {
+		override = override.Alias
+	}
+
+	if base.Kind == yaml.MappingNode && override.Kind == yaml.MappingNode {
+		merged := v.copyNode(override)
+		merged.Content = nil
+		for i := 0; i+1 < len(base.Content); i += 2 {
+			key, value := base.Content[i], base.Content[i+1]
+			if overrideValue := mappingValue(override, key.Value); overrideValue != nil {
+				value = v.mergeNodes(value, overrideValue)
+			}
+			merged.Content = append(merged.Content, key, value)
+		}
+		for i := 0; i+1 < len(override.Content); i += 2 {
+			if mappingValue(base, override.Content[i].Value) == nil {
+				merged.Content = append(merged.Content, override.Content[i], override.Content[i+1])
+			}
+		}
+		return merged
+	}
+
+	if base.Kind == yaml.SequenceNode && override.Kind == yaml.SequenceNode && override.Tag == "!append" {
+		merged := v.copyNode(override)
+		merged.Content = append(append([]*yaml.Node{}, base.Content...), override.Content...)
+		return merged
+	}
+	return override
+}
+
+// merges defaults and nodes they extend into every node, node values override values of extended
+// node which override defaults
+func resolveNodes(v *validator, root *yaml.Node) {
+	nodes := mappingValue(root, "nodes")
+	if nodes == nil || nodes.Kind != yaml.SequenceNode {
+		return
+	}
+	defaults := mappingValue(root, "defaults")
+	if defaults != nil && defaults.Kind != yaml.MappingNode {
+		defaults = nil
+	}
+
+	byName := map[string]*yaml.Node{}
+	for _, node := range nodes.Content {
+		if name := mappingValue(node, "name"); name != nil {
+			byName[name.Value] = node
+		}
+	}
+
+	resolved := map[*yaml.Node]*yaml.Node{}
+	resolving := map[*yaml.Node]bool{}
+	var resolve func(node *yaml.Node) *yaml.Node
+	resolve = func(node *yaml.Node) *yaml.Node {
+		if result, ok := resolved[node]; ok {
+			return result
+		}
+
+		base := defaults
+		if extends := mappingValue(node, "extends"); extends != nil {
+			parent, ok := byName[extends.Value]
+			if !ok {
+				v.errorAt(extends, "node %s to extend is not defined", extends.Value)
+			} else if resolving[parent] {
+				v.errorAt(extends, "circular extends of node %s", extends.Value)
+			} else {
+				resolving[node] = true
+				base = resolve(parent)
+				resolving[node] = false
+			}
+		}
+
+		result := node
+		if base != nil && node.Kind == yaml.MappingNode {
+			// extended node name and extends are not inherited
+			result = v.mergeNodes(v.withoutKey(v.withoutKey(base, "name"), "extends"), node)
+		}
+		resolved[node] = result
+		return result
+	}
+
+	for i, node := range nodes.Content {
+		nodes.Content[i] = resolve(node)
+	}
+}
+
+// ${VAR}, ${VAR:-default}, ${VAR:?message} and $${ escape
+var variableRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:-|:\?)([^}]*))?\}`)
+
+// expands environment variables in scalar values: ${VAR} must be set, ${VAR:-default} is default
+// if VAR is empty or not set, ${VAR:?message} is an error with message if VAR is empty or not set,
+// $${ is left as ${
+func interpolate(v *validator, node *yaml.Node) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, item := range node.Content {
+			interpolate(v, item)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			interpolate(v, node.Content[i])
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return
+		}
+		value := variableRegexp.ReplaceAllStringFunc(node.Value, func(match string) string {
+			if match == "$${" {
+				return "${"
+			}
+			parsed := variableRegexp.FindStringSubmatch(match)
+			name, operator, argument := parsed[1], parsed[2], parsed[3]
+			value, set := os.LookupEnv(name)
+			switch {
+			case operator == ":-" && value == "":
+				return argument
+			case operator == ":?" && value == "":
+				if argument == "" {
+					argument = "required variable is not set"
+				}
+				v.errorAt(node, "%s: %s", name, argument)
+			case !set:
+				v.errorAt(node, "variable %s is not set, use ${%s:-} if it is optional", name, name)
+			}
+			return value
+		})
+		if value != node.Value {
+			node.Value = value
+			// plain scalars are resolved again, e.g. port: ${SSH_PORT} is int
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	}
+}
+
+// renders configuration file as go template, errors refer to lines of the template
+func renderConfigTemplate(file string, data []byte) (rendered []byte, err error) {
+	funcs := template.FuncMap{
+		// value of environment variable, empty if not set
+		"env": os.Getenv,
+		// {{ env "BOX" | default "ubuntu/focal64" }}
+		"default": func(def, value string) string {
+			if value == "" {
+				return def
+			}
+			return value
+		},
+		// {{ env "BRANCH" | required "BRANCH must be set" }}
+		"required": func(msg, value string) (string, error) {
+			if value == "" {
+				return "", fmt.Errorf("%s", msg)
+			}
+			return value, nil
+		},
+		// content of the file, path is relative to current directory
+		"file": func(path string) (string, error) {
+			content, err := ioutil.ReadFile(path)
+			return string(content), err
+		},
+	}
+
+	tpl, err := template.New(file).Funcs(funcs).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err = tpl.Execute(&buf, nil); err != nil {
+		return
+	}
+	return buf.Bytes(), nil
+}
+
+// reads configuration file with files it includes, included files are merged in order and the
+// including file is merged into them; files is include chain used to detect circular includes
+func (v *validator) loadFile(file string, templated bool, files []string) *yaml.Node {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		v.errs = append(v.errs, &configError{msg: err.Error()})
+		return nil
+	}
+	if templated {
+		if data, err = renderConfigTemplate(file, data); err != nil {
+			v.errs = append(v.errs, &configError{msg: err.Error()})
+			return nil
+		}
+	}
+
+	var document yaml.Node
+	if err = yaml.Unmarshal(data, &document); err != nil {
+		v.errs = append(v.errs, yamlErrors(file, err)...)
+		return nil
+	}
+	if len(document.Content) == 0 {
+		v.errs = append(v.errs, &configError{file: file, msg: "configuration is empty"})
+		return nil
+	}
+	root := document.Content[0]
+	v.register(root, file)
+
+	include := mappingValue(root, "include")
+	if include == nil {
+		return root
+	}
+	if include.Kind != yaml.SequenceNode {
+		v.errorAt(include, "include must be list of files")
+		return root
+	}
+	var base *yaml.Node
+	for _, item := range include.Content {
+		// included files are read before the rest of configuration is interpolated
+		errs := len(v.errs)
+		if interpolate(v, item); len(v.errs) > errs {
+			continue
+		}
+		path := item.Value
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(file), path)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			v.errorAt(item, "included file %s does not exist", item.Value)
+			continue
+		}
+		circular := filepath.Clean(path) == filepath.Clean(file)
+		for _, f := range files {
+			circular = circular || filepath.Clean(path) == filepath.Clean(f)
+		}
+		if circular {
+			v.errorAt(item, "circular include of %s", item.Value)
+			continue
+		}
+		if included := v.loadFile(path, templated, append(files, file)); included != nil {
+			base = v.mergeConfigs(base, included)
+		}
+	}
+	return v.mergeConfigs(base, v.withoutKey(root, "include"))
+}
+
+// lists merged by names of their items when configuration files are combined
+var namedLists = []string{"nodes", "platforms", "suites"}
+
+// returns override configuration merged into base: nodes, platforms and suites with the same name
+// are deep merged and new ones are appended, other keys are merged with mergeNodes
+func (v *validator) mergeConfigs(base, override *yaml.Node) *yaml.Node {
+	if base == nil {
+		return override
+	}
+	merged := v.mergeNodes(base, override)
+	if merged.Kind != yaml.MappingNode {
+		return merged
+	}
+
+	for _, key := range namedLists {
+		baseList, overrideList := mappingValue(base, key), mappingValue(override, key)
+		if baseList == nil || overrideList == nil || baseList.Kind != yaml.SequenceNode || overrideList.Kind != yaml.SequenceNode {
+			continue
+		}
+
+		list := v.copyNode(overrideList)
+		list.Content = append([]*yaml.Node{}, baseList.Content...)
+		for _, item := range overrideList.Content {
+			index := -1
+			if name := mappingValue(item, "name"); name != nil {
+				for i, existing := range list.Content {
+					if existingName := mappingValue(existing, "name"); existingName != nil && existingName.Value == name.Value {
+						index = i
+					}
+				}
+			}
+			if index < 0 {
+				list.Content = append(list.Content, item)
+			} else {
+				list.Content[index] = v.mergeNodes(list.Content[index], item)
+			}
+		}
+
+		for i := 0; i+1 < len(merged.Content); i += 2 {
+			if merged.Content[i].Value == key {
+				merged.Content[i+1] = list
+			}
+		}
+	}
+	return merged
+}
+
+// loads configuration files, later files override earlier ones, all problems are returned as configErrors
+func loadConfig(files []string, templated bool, conf *configType) error {
+	v := newValidator(files[0])
+	var root *yaml.Node
+	for _, file := range files {
+		if loaded := v.loadFile(file, templated, nil); loaded != nil {
+			root = v.mergeConfigs(root, loaded)
+		}
+	}
+	if root == nil {
+		return v.sortedErrors()
+	}
+	return v.decode(root, conf)
+}
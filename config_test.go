@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writes files into temporary directory, returns the directory
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// loads configuration files of the directory, errors refer to files relative to it
+func loadTestConfig(t *testing.T, files map[string]string, load []string) (conf configType, err error) {
+	dir := writeConfigFiles(t, files)
+	var paths []string
+	for _, file := range load {
+		paths = append(paths, filepath.Join(dir, file))
+	}
+	if err = loadConfig(paths, false, &conf); err != nil {
+		err = errors.New(strings.Replace(err.Error(), dir+string(filepath.Separator), "", -1))
+	}
+	return
+}
+
+// returns node of the configuration by name
+func testNode(t *testing.T, conf *configType, name string) nodeType {
+	for _, node := range conf.Nodes {
+		if node.Name == name {
+			return node
+		}
+	}
+	t.Fatalf("node %s is not defined", name)
+	return nodeType{}
+}
+
+// returns names of the nodes in order
+func nodeNames(conf *configType) (names []string) {
+	for _, node := range conf.Nodes {
+		names = append(names, node.Name)
+	}
+	return
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		load  []string
+		env   map[string]string
+		check func(t *testing.T, conf *configType)
+	}{
+		{
+			name: "includes are merged by node name",
+			files: map[string]string{
+				"common.yml": `
+nodes:
+  - name: web
+    provider: {name: docker, image: nginx}
+  - name: db
+    provider: {name: docker, image: postgres}
+`,
+				"clover.yml": `
+include: [common.yml]
+nodes:
+  - name: web
+    provider: {image: caddy}
+  - name: app
+    provider: {name: docker, image: app}
+`,
+			},
+			load: []string{"clover.yml"},
+			check: func(t *testing.T, conf *configType) {
+				if names := strings.Join(nodeNames(conf), " "); names != "web db app" {
+					t.Errorf("nodes %s, expected web db app", names)
+				}
+				if web := testNode(t, conf, "web"); web.Provider.Name != "docker" || web.Provider.Image != "caddy" {
+					t.Errorf("web provider %s %s, expected docker caddy", web.Provider.Name, web.Provider.Image)
+				}
+			},
+		},
+		{
+			name: "overlay overrides earlier files",
+			files: map[string]string{
+				"clover.yml": `
+project: demo
+nodes:
+  - name: web
+    provider: {name: docker, image: nginx, cpus: 1}
+`,
+				"ci.yml": `
+nodes:
+  - name: web
+    provider: {cpus: 4}
+`,
+			},
+			load: []string{"clover.yml", "ci.yml"},
+			check: func(t *testing.T, conf *configType) {
+				web := testNode(t, conf, "web")
+				if web.Provider.Cpus != 4 || web.Provider.Image != "nginx" || conf.Project != "demo" {
+					t.Errorf("web cpus %d image %s project %s, expected 4 nginx demo", web.Provider.Cpus, web.Provider.Image, conf.Project)
+				}
+			},
+		},
+		{
+			name: "defaults and extends with !append",
+			files: map[string]string{
+				"clover.yml": `
+defaults:
+  provider: {name: docker, image: debian}
+  provisioner:
+    - {name: shell, content: base}
+nodes:
+  - name: web
+    provisioner: !append
+      - {name: shell, content: web}
+  - name: db
+    provisioner:
+      - {name: shell, content: db}
+  - name: web2
+    extends: web
+    provider: {image: alpine}
+`,
+			},
+			load: []string{"clover.yml"},
+			check: func(t *testing.T, conf *configType) {
+				tests := map[string][]string{"web": {"base", "web"}, "db": {"db"}, "web2": {"base", "web"}}
+				for name, expected := range tests {
+					node := testNode(t, conf, name)
+					var contents []string
+					for _, provisioner := range node.Provisioner {
+						contents = append(contents, provisioner.Content)
+					}
+					if strings.Join(contents, " ") != strings.Join(expected, " ") {
+						t.Errorf("%s provisioners %v, expected %v", name, contents, expected)
+					}
+				}
+				if web2 := testNode(t, conf, "web2"); web2.Provider.Image != "alpine" || web2.Provider.Name != "docker" || web2.Extends != "web" {
+					t.Errorf("web2 provider %s %s extends %s, expected docker alpine web", web2.Provider.Name, web2.Provider.Image, web2.Extends)
+				}
+			},
+		},
+		{
+			name: "matrix of suites and platforms",
+			files: map[string]string{
+				"clover.yml": `
+platforms:
+  - name: debian
+    provider: {name: docker, image: debian}
+  - name: alpine
+    provider: {name: docker, image: alpine}
+suites:
+  - name: web
+    includes: [debian]
+    provisioner:
+      - {name: shell, content: web}
+  - name: db
+    excludes: [debian]
+`,
+			},
+			load: []string{"clover.yml"},
+			check: func(t *testing.T, conf *configType) {
+				if names := strings.Join(nodeNames(conf), " "); names != "web-debian db-alpine" {
+					t.Errorf("nodes %s, expected web-debian db-alpine", names)
+				}
+				if node := testNode(t, conf, "web-debian"); node.Provider.Image != "debian" || len(node.Provisioner) != 1 {
+					t.Errorf("web-debian image %s with %d provisioners, expected debian with 1", node.Provider.Image, len(node.Provisioner))
+				}
+			},
+		},
+		{
+			name: "environment variables",
+			files: map[string]string{
+				"clover.yml": `
+nodes:
+  - name: web
+    provider: {name: docker, image: "${CLOVER_TEST_IMAGE}"}
+    ssh:
+      port: ${CLOVER_TEST_PORT}
+      user: ${CLOVER_TEST_UNSET:-deploy}
+    provisioner:
+      - {name: shell, content: "echo $${HOME}"}
+`,
+			},
+			load: []string{"clover.yml"},
+			env:  map[string]string{"CLOVER_TEST_IMAGE": "nginx", "CLOVER_TEST_PORT": "2222"},
+			check: func(t *testing.T, conf *configType) {
+				web := testNode(t, conf, "web")
+				if web.Provider.Image != "nginx" || web.SSH.Port != 2222 || web.SSH.User != "deploy" || web.Provisioner[0].Content != "echo ${HOME}" {
+					t.Errorf("unexpected interpolation: image %s, port %d, user %s, content %s",
+						web.Provider.Image, web.SSH.Port, web.SSH.User, web.Provisioner[0].Content)
+				}
+			},
+		},
+		{
+			name: "environment variables in include",
+			files: map[string]string{
+				"ci.yml": `
+nodes:
+  - name: web
+    provider: {name: docker, image: nginx}
+`,
+				"clover.yml": `
+include: ["${CLOVER_TEST_ENV}.yml"]
+`,
+			},
+			load: []string{"clover.yml"},
+			env:  map[string]string{"CLOVER_TEST_ENV": "ci"},
+			check: func(t *testing.T, conf *configType) {
+				testNode(t, conf, "web")
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			conf, err := loadTestConfig(t, test.files, test.load)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.check(t, &conf)
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		load  []string
+		errs  []string
+	}{
+		{
+			name: "unknown key",
+			files: map[string]string{
+				"clover.yml": `
+nodes:
+  - name: web
+    provider:
+      name: docker
+      image: nginx
+      imag: nginx
+`,
+			},
+			load: []string{"clover.yml"},
+			errs: []string{"clover.yml:7:7: unknown key nodes[0].provider.imag"},
+		},
+		{
+			name: "unknown key in included file",
+			files: map[string]string{
+				"common.yml": `
+defaults:
+  provder: {name: docker}
+`,
+				"clover.yml": `
+include: [common.yml]
+nodes:
+  - name: web
+    provider: {name: docker, image: nginx}
+`,
+			},
+			load: []string{"clover.yml"},
+			errs: []string{"common.yml:3:3: unknown key defaults.provder"},
+		},
+		{
+			name: "circular include",
+			files: map[string]string{
+				"a.yml": `
+include: [b.yml]
+`,
+				"b.yml": `
+include:
+  - a.yml
+nodes:
+  - name: web
+    provider: {name: docker, image: nginx}
+`,
+			},
+			load: []string{"a.yml"},
+			errs: []string{"b.yml:3:5: circular include of a.yml"},
+		},
+		{
+			name: "unset variables",
+			files: map[string]string{
+				"clover.yml": `
+nodes:
+  - name: web
+    provider: {name: docker, image: "${CLOVER_TEST_UNSET}"}
+    ssh:
+      host: ${CLOVER_TEST_UNSET:?host of web node}
+`,
+			},
+			load: []string{"clover.yml"},
+			errs: []string{
+				"clover.yml:4:37: variable CLOVER_TEST_UNSET is not set, use ${CLOVER_TEST_UNSET:-} if it is optional",
+				"clover.yml:4:37: image is required for docker provider",
+				"clover.yml:6:13: CLOVER_TEST_UNSET: host of web node",
+			},
+		},
+		{
+			name: "extends",
+			files: map[string]string{
+				"clover.yml": `
+nodes:
+  - name: a
+    extends: b
+    provider: {name: docker, image: nginx}
+  - name: b
+    extends: a
+  - name: c
+    extends: d
+    provider: {name: docker, image: nginx}
+`,
+			},
+			load: []string{"clover.yml"},
+			errs: []string{
+				"clover.yml:6:5: provider name is required",
+				"clover.yml:7:14: circular extends of node a",
+				"clover.yml:9:14: node d to extend is not defined",
+			},
+		},
+		{
+			name: "matrix platform is not defined",
+			files: map[string]string{
+				"clover.yml": `
+platforms:
+  - name: debian
+    provider: {name: docker, image: debian}
+suites:
+  - name: web
+    includes: [centos]
+`,
+			},
+			load: []string{"clover.yml"},
+			errs: []string{
+				"clover.yml:6:3: no nodes defined",
+				"clover.yml:7:16: platform centos in includes of suite web is not defined",
+			},
+		},
+		{
+			name: "missing include",
+			files: map[string]string{
+				"clover.yml": `
+include:
+  - common.yml
+  - ${CLOVER_TEST_UNSET}.yml
+nodes:
+  - name: web
+    provider: {name: docker, image: nginx}
+`,
+			},
+			load: []string{"clover.yml"},
+			errs: []string{
+				"clover.yml:3:5: included file common.yml does not exist",
+				"clover.yml:4:5: variable CLOVER_TEST_UNSET is not set, use ${CLOVER_TEST_UNSET:-} if it is optional",
+			},
+		},
+		{
+			name: "type error",
+			files: map[string]string{
+				"clover.yml": `
+nodes:
+  - name: web
+    provider: {name: docker, image: nginx, cpus: many}
+`,
+			},
+			load: []string{"clover.yml"},
+			errs: []string{"clover.yml:4:50: nodes[0].provider.cpus: cannot unmarshal !!str `many` into int"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, test.files, test.load)
+			if err == nil {
+				t.Fatal("expected errors")
+			}
+			expected := strings.Join(append([]string{"invalid configuration:"}, test.errs...), "\n  ")
+			if err.Error() != expected {
+				t.Errorf("errors\n%s\nexpected\n%s", err, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/koding/vagrantutil"
+)
+
+// creates node with its provider, uploads files and runs provisioners
+func converge(p *project, node *nodeType) (err error) {
+	defer func() {
+		if stateErr := p.recordRun(node, "converge", err); err == nil {
+			err = stateErr
+		}
+	}()
+
+	provider, err := p.provider(node)
+	if err != nil {
+		return
+	}
+
+	// node destroyed outside of clover is created from scratch, its recorded provisioner runs and host key are stale
+	if status, _ := provider.Status(node); status == vagrantutil.NotCreated {
+		if err = p.knownHosts(node).forget(); err != nil {
+			return
+		}
+		if err = p.updateState(node, func(*nodeState) *nodeState { return nil }); err != nil {
+			return
+		}
+	}
+
+	if err = provider.Create(node); err != nil {
+		return
+	}
+	p.forgetHost(node)
+	if err = p.recordStage(node, provider, stageCreated); err != nil {
+		return
+	}
+	if err = p.updateHosts(node); err != nil {
+		return
+	}
+
+	transport, err := p.transport(node)
+	if err != nil {
+		return
+	}
+
+	// uploading files
+	for _, file := range node.Files {
+
+		// check if file exists
+		if transport.Run(fmt.Sprintf("test -e %s", shellQuote(file.Path)), nil, node.errWriter()) == nil {
+			continue
+		}
+
+		if err = transport.Upload(file.Path, []byte(file.Content), node.errWriter()); err != nil {
+			return
+		}
+
+		// reset owner and group
+		if file.User != "" && file.Group != "" {
+			if err = transport.Run(fmt.Sprintf("chown %s:%s %s", file.User, file.Group, shellQuote(file.Path)), nil, node.errWriter()); err != nil {
+				return
+			}
+		}
+
+		// reset mode
+		if file.Mode != 0 {
+			if err = transport.Run(fmt.Sprintf("chmod %o %s", file.Mode, shellQuote(file.Path)), nil, node.errWriter()); err != nil {
+				return
+			}
+		}
+	}
+
+	state, err := p.nodeState(node)
+	if err != nil {
+		return
+	}
+	var previous map[string]string
+	if state != nil {
+		previous = state.Provisioners
+	}
+
+	// converge stage tasks
+	for i, provisioner := range node.Provisioner {
+		key := provisionerKey(provisioner)
+		var hash string
+		if provisioner.RunOnce || provisioner.SkipUnchanged {
+			if hash, err = p.provisionerHash(provisioner); err != nil {
+				return
+			}
+		}
+		if reason := skipProvisioner(provisioner, previous, key, hash); reason != "" {
+			fmt.Fprintf(node.outWriter(), "Skipping %s provisioner of %s node, %s\n", provisioner.Name, node.Name, reason)
+			continue
+		}
+
+		// ansible installed and run inside the node
+		if provisioner.Name == "ansible-local" {
+			fmt.Fprintf(node.outWriter(), "Provisioning %s node with ansible-local:\n", node.Name)
+			if err = transport.Run(ansiblesh, node.outWriter(), node.errWriter()); err != nil {
+				return
+			}
+			if provisioner.Playbook != "" {
+				if err = transport.Run("ansible-playbook "+provisioner.Playbook, node.outWriter(), node.errWriter()); err != nil {
+					return
+				}
+			}
+		}
+
+		// ansible provisioner, run from the host with inventory of all nodes limited to this one
+		if provisioner.Name == "ansible" {
+			fmt.Fprintf(node.outWriter(), "Provisioning %s node with ansible:\n", node.Name)
+			if err = runAnsible(p, provisioner, node.Name, node.outWriter(), node.errWriter()); err != nil {
+				return
+			}
+		}
+
+		// shell provisioners
+		if provisioner.Name == "shell" {
+			script := filepath.Join("/root/.clover", fmt.Sprintf("%d.sh", i))
+			if err = transport.Upload(script, []byte(provisioner.Content), node.errWriter()); err != nil {
+				return
+			}
+			if err = transport.Run("bash "+script, node.outWriter(), node.errWriter()); err != nil {
+				return
+			}
+		}
+
+		if err = p.recordProvisioner(node, key, hash); err != nil {
+			return
+		}
+	}
+
+	return p.recordStage(node, provider, stageConverged)
+}
+
+// destroys node with its provider and removes its state directory
+func destroy(p *project, node *nodeType) (err error) {
+	provider, err := p.provider(node)
+	if err != nil {
+		return
+	}
+	if err = provider.Destroy(node); err != nil {
+		return
+	}
+	p.forgetHost(node)
+	// static machine keeps its host key
+	if node.Provider.Name != "static" {
+		if err = p.knownHosts(node).forget(); err != nil {
+			return
+		}
+	}
+	if err = p.updateState(node, func(*nodeState) *nodeState { return nil }); err != nil {
+		return
+	}
+	if err = os.RemoveAll(p.nodeDir(node)); err != nil {
+		return fmt.Errorf("Failed to remove %s", p.nodeDir(node))
+	}
+	return
+}
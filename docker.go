@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/koding/vagrantutil"
+)
+
+func init() {
+	registerProvider("docker", newContainerProvider)
+	registerProvider("podman", newContainerProvider)
+}
+
+// ansible connection plugins for container providers
+var ansibleConnections = map[string]string{
+	"docker": "docker",
+	"podman": "containers.podman.podman",
+}
+
+// containerProvider runs nodes as long-running containers with docker compatible cli
+type containerProvider struct {
+	project *project
+	binary  string
+}
+
+func newContainerProvider(p *project, name string) (provider Provider, err error) {
+	if err = execInstalled(name, "version"); err != nil {
+		return
+	}
+	return &containerProvider{project: p, binary: name}, nil
+}
+
+func (c *containerProvider) run(node *nodeType, args ...string) (err error) {
+	cmd := exec.Command(c.binary, args...)
+	cmd.Stdout = node.outWriter()
+	cmd.Stderr = node.errWriter()
+	return cmd.Run()
+}
+
+// converts container state into vagrant status, image or volume with the same name is not a container
+func (c *containerProvider) Status(node *nodeType) (status vagrantutil.Status, err error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.binary, "container", "inspect", "--format", "{{ .State.Status }}", c.project.instanceName(node))
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(strings.ToLower(stderr.String()), "no such") {
+			return vagrantutil.NotCreated, nil
+		}
+		return vagrantutil.Unknown, fmt.Errorf("%s container inspect failed: %s", c.binary, strings.TrimSpace(stderr.String()))
+	}
+
+	switch strings.TrimSpace(string(out)) {
+	case "running":
+		status = vagrantutil.Running
+	case "created", "exited", "stopped", "configured":
+		status = vagrantutil.PowerOff
+	case "paused":
+		status = vagrantutil.Saved
+	case "dead":
+		status = vagrantutil.Aborted
+	case "restarting":
+		status = vagrantutil.Preparing
+	default:
+		status = vagrantutil.Unknown
+	}
+	return
+}
+
+// builds "docker run" arguments from node provider section
+func (c *containerProvider) runArgs(node *nodeType) (args []string, err error) {
+	nodeDir, err := filepath.Abs(c.project.nodeDir(node))
+	if err != nil {
+		return
+	}
+
+	args = []string{"run", "--detach",
+		"--name", c.project.instanceName(node),
+		"--hostname", node.Name,
+		"--label", "clover.node=" + node.Name,
+		"--volume", nodeDir + ":/clover",
+	}
+	if node.Provider.Privileged {
+		args = append(args, "--privileged", "--cgroupns=host", "--volume", "/sys/fs/cgroup:/sys/fs/cgroup:rw", "--tmpfs", "/run", "--tmpfs", "/tmp")
+	}
+
+	// synced folders become bind mounts
+	for _, folder := range node.Provider.SyncedFolders {
+		dirs, err := resolveDir(folder)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--volume", fmt.Sprintf("%s:%s", dirs[0], dirs[1]))
+	}
+
+	// forwarded ports become published ports, <host>:<guest>:<protocol> or <host_ip>:<host>:<guest_ip>:<guest>:<protocol>
+	for _, port := range node.Provider.Network.ForwardedPort {
+		list := strings.Split(port, ":")
+		switch len(list) {
+		case 3:
+			args = append(args, "--publish", fmt.Sprintf("127.0.0.1:%s:%s/%s", list[0], list[1], list[2]))
+		case 5:
+			args = append(args, "--publish", fmt.Sprintf("%s:%s:%s/%s", list[0], list[1], list[3], list[4]))
+		default:
+			return nil, fmt.Errorf("Cannot parse forwarded port %s", port)
+		}
+	}
+
+	args = append(args, node.Provider.Image)
+	if node.Provider.Command != "" {
+		args = append(args, "sh", "-c", node.Provider.Command)
+	}
+	return
+}
+
+// runs container if not created, starts it if stopped
+func (c *containerProvider) Create(node *nodeType) (err error) {
+	// .<stateDir>/<node.Name>, mounted into container as /clover
+	if err = os.MkdirAll(c.project.nodeDir(node), 0755); err != nil {
+		return
+	}
+
+	status, err := c.Status(node)
+	if err != nil {
+		return
+	}
+	switch status {
+	case vagrantutil.NotCreated:
+		args, err := c.runArgs(node)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(node.outWriter(), c.binary, strings.Join(args, " "))
+		return c.run(node, args...)
+	case vagrantutil.PowerOff:
+		return c.run(node, "start", c.project.instanceName(node))
+	case vagrantutil.Running:
+		return
+	}
+	return fmt.Errorf("State is %s, destroy and run converge again", status)
+}
+
+func (c *containerProvider) Halt(node *nodeType) error {
+	return c.run(node, "stop", c.project.instanceName(node))
+}
+
+func (c *containerProvider) Destroy(node *nodeType) (err error) {
+	status, err := c.Status(node)
+	if err != nil || status == vagrantutil.NotCreated {
+		return
+	}
+	return c.run(node, "rm", "--force", "--volumes", c.project.instanceName(node))
+}
+
+func (c *containerProvider) Connect(node *nodeType) (Transport, error) {
+	return newExecTransport(c.binary, "exec", "--interactive", c.project.instanceName(node)), nil
+}
+
+// ansible reaches container with connection plugin, no ssh involved
+func (c *containerProvider) Address(node *nodeType) (sshItems, error) {
+	return sshItems{Host: c.project.instanceName(node), Connection: ansibleConnections[c.binary]}, nil
+}
+
+func (c *containerProvider) Login(node *nodeType) (err error) {
+	cmd := exec.Command(c.binary, "exec", "--interactive", "--tty", c.project.instanceName(node),
+		"sh", "-c", "command -v bash >/dev/null && exec bash || exec sh")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	return
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// markers of /etc/hosts block managed by clover, the block is replaced on every update
+const (
+	hostsBegin = "# BEGIN clover managed hosts"
+	hostsEnd   = "# END clover managed hosts"
+)
+
+// replaces managed block of /etc/hosts in place, container runtimes bind mount the file so it cannot be renamed
+const hostsCommand = `sed '/^%s$/,/^%s$/d' /etc/hosts > /etc/hosts.clover && printf '%%s\n' %s >> /etc/hosts.clover && cat /etc/hosts.clover > /etc/hosts && rm -f /etc/hosts.clover`
+
+// returns address other nodes reach the node at: static ip of private or public network,
+// otherwise the last global address reported by the node, ok is false if node is not running
+func (p *project) nodeAddress(node *nodeType, stderr io.Writer) (address string, ok bool) {
+	for _, network := range node.Provider.Network.PrivateNetwork {
+		if network.IP != "" {
+			return network.IP, true
+		}
+	}
+	for _, network := range node.Provider.Network.PublicNetwork {
+		if network.IP != "" {
+			return network.IP, true
+		}
+	}
+	host, ok := p.ansibleHost(node, stderr)
+	return host.PrivateIP, ok && host.PrivateIP != ""
+}
+
+// NAT address of vagrant virtualbox and qemu user networking, every such node has it
+const natAddress = "10.0.2.15"
+
+// returns names of nodes whose address does not reach them from other nodes: NAT address or
+// address reported by several nodes
+func unreachableAddresses(addresses map[string]string) (names []string) {
+	count := map[string]int{}
+	for _, address := range addresses {
+		count[address]++
+	}
+	for name, address := range addresses {
+		if address == natAddress || count[address] > 1 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// writes addresses of the other running nodes into /etc/hosts of every running node, called after
+// the node is created so its peers resolve it by name, static nodes are listed but never modified
+func (p *project) updateHosts(created *nodeType) (err error) {
+	addresses, running := map[string]string{}, map[string]bool{}
+	for i := range p.conf.Nodes {
+		if address, ok := p.nodeAddress(&p.conf.Nodes[i], created.errWriter()); ok {
+			addresses[p.conf.Nodes[i].Name] = address
+			running[p.conf.Nodes[i].Name] = true
+		}
+	}
+	// wrong entry is worse than none, node is still updated with addresses of its peers
+	for _, name := range unreachableAddresses(addresses) {
+		fmt.Fprintf(created.errWriter(), "Skipping %s node in /etc/hosts, its address %s is NAT address or address of other node too, "+
+			"add private network with static ip to reach it by name\n", name, addresses[name])
+		delete(addresses, name)
+	}
+
+	for i := range p.conf.Nodes {
+		node := &p.conf.Nodes[i]
+		if !running[node.Name] || node.Provider.Name == "static" {
+			continue
+		}
+		if err = p.writeHosts(node, addresses, node.Name == created.Name, created.errWriter()); err != nil {
+			if node.Name == created.Name {
+				return
+			}
+			// peer may be stopped or being recreated, it is updated after its own create
+			fmt.Fprintf(created.errWriter(), "Failed to update /etc/hosts of %s node: %s\n", node.Name, err)
+			err = nil
+		}
+	}
+	return
+}
+
+// returns lock of /etc/hosts of the node, only updates of the same node wait for each other
+func (p *project) hostsLock(node *nodeType) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hostsLocks == nil {
+		p.hostsLocks = map[string]*sync.Mutex{}
+	}
+	if p.hostsLocks[node.Name] == nil {
+		p.hostsLocks[node.Name] = &sync.Mutex{}
+	}
+	return p.hostsLocks[node.Name]
+}
+
+// writes managed block with all nodes but the node itself, unchanged block is written again only
+// with force, restarted containers get fresh /etc/hosts; stderr is of the node being created
+func (p *project) writeHosts(node *nodeType, addresses map[string]string, force bool, stderr io.Writer) (err error) {
+	lock := p.hostsLock(node)
+	lock.Lock()
+	defer lock.Unlock()
+
+	lines := []string{hostsBegin}
+	for name, address := range addresses {
+		if name != node.Name {
+			lines = append(lines, fmt.Sprintf("%s %s", address, name))
+		}
+	}
+	sort.Strings(lines[1:])
+	lines = append(lines, hostsEnd)
+
+	hash := configHash(lines)
+	state, err := p.nodeState(node)
+	if err != nil || (!force && state != nil && state.Hashes["hosts"] == hash) {
+		return
+	}
+
+	transport, err := p.transport(node)
+	if err != nil {
+		return
+	}
+
+	quoted := make([]string, len(lines))
+	for i, line := range lines {
+		quoted[i] = shellQuote(line)
+	}
+	if err = transport.Run(fmt.Sprintf(hostsCommand, hostsBegin, hostsEnd, strings.Join(quoted, " ")), nil, stderr); err != nil {
+		return
+	}
+	return p.updateState(node, func(state *nodeState) *nodeState {
+		if state.Stage == "" {
+			// node was not created by clover
+			return nil
+		}
+		state.Hashes["hosts"] = hash
+		return state
+	})
+}
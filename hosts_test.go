@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnreachableAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses map[string]string
+		expected  []string
+	}{
+		{"distinct addresses", map[string]string{"web": "192.168.56.10", "db": "172.17.0.3"}, nil},
+		{"nat address", map[string]string{"web": natAddress, "db": "192.168.56.11"}, []string{"web"}},
+		{"shared address", map[string]string{"web": "10.0.3.15", "db": "10.0.3.15", "app": "10.0.3.16"}, []string{"db", "web"}},
+		{"no addresses", map[string]string{}, nil},
+	}
+	for _, test := range tests {
+		if names := unreachableAddresses(test.addresses); !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%s: %v, expected %v", test.name, names, test.expected)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHosts verifies host key of the node against <stateDir>/known_hosts, key is trusted on first
+// connection and recorded under node name, so address of the node may change, e.g. vagrant port
+type knownHosts struct {
+	path string
+	// name of the host in known_hosts, address is what it is checked as
+	alias, address string
+	// project.knownHostsMu, nodes are connected to concurrently
+	mu *sync.Mutex
+}
+
+func (p *project) knownHosts(node *nodeType) *knownHosts {
+	return &knownHosts{path: filepath.Join(p.stateDir, "known_hosts"), alias: node.Name, address: net.JoinHostPort(node.Name, "22"), mu: &p.knownHostsMu}
+}
+
+// returns known hosts of proxy jump host of the node, it is recorded under its <host>:<port> address
+func (k *knownHosts) bastion(address string) *knownHosts {
+	return &knownHosts{path: k.path, alias: knownhosts.Normalize(address), address: address, mu: k.mu}
+}
+
+// ssh host key callback, unknown key is recorded, changed key is an error
+func (k *knownHosts) check(hostname string, remote net.Addr, key ssh.PublicKey) (err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err = os.MkdirAll(filepath.Dir(k.path), 0755); err != nil {
+		return
+	}
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	callback, err := knownhosts.New(k.path)
+	if err != nil {
+		return
+	}
+	err = callback(k.address, remote, key)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return
+	}
+	if len(keyErr.Want) > 0 {
+		return &hostKeyError{alias: k.alias, remote: remote, path: k.path}
+	}
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{k.alias}, key))
+	return
+}
+
+// hostKeyError is changed host key of the node, it is not retried
+type hostKeyError struct {
+	alias  string
+	remote net.Addr
+	path   string
+}
+
+func (e *hostKeyError) Error() string {
+	return fmt.Sprintf("host key of %s (%s) does not match the one recorded in %s on first connection, "+
+		"destroy the node or remove its line from %s if the change is expected", e.alias, e.remote, e.path, e.path)
+}
+
+// host key algorithms supported by ssh client, in its default order
+var hostKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+}
+
+// returns host key algorithms with those of recorded keys first, ssh client may prefer other algorithm
+// than the one recorded, e.g. by ansible, server without recorded key type fails the check
+func (k *knownHosts) algorithms() (algorithms []string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	data, _ := ioutil.ReadFile(k.path)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != k.alias {
+			continue
+		}
+		if fields[1] == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, fields[1])
+	}
+	for _, algorithm := range hostKeyAlgorithms {
+		known := false
+		for _, a := range algorithms {
+			known = known || a == algorithm
+		}
+		if !known {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return
+}
+
+// removes recorded keys of the node, the next one is trusted on first connection again
+func (k *knownHosts) forget() (err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	data, err := ioutil.ReadFile(k.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 0 || fields[0] != k.alias {
+			kept = append(kept, line)
+		}
+	}
+	return ioutil.WriteFile(k.path, []byte(strings.Join(kept, "")), 0600)
+}
+
+// returns ssh client options which verify host key of the node the same way, new key is accepted and recorded
+func (k *knownHosts) sshOptions() []string {
+	path, err := filepath.Abs(k.path)
+	if err != nil {
+		path = k.path
+	}
+	return []string{"-o", "UserKnownHostsFile=" + path, "-o", "HostKeyAlias=" + k.alias, "-o", "StrictHostKeyChecking=accept-new"}
+}
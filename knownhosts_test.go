@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// returns new ed25519 host key
+func testHostKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKnownHosts(t *testing.T) {
+	p := &project{stateDir: t.TempDir()}
+	web, db := p.knownHosts(&nodeType{Name: "web"}), p.knownHosts(&nodeType{Name: "db"})
+	bastion := web.bastion("bastion.lab:2222")
+	first, second := testHostKey(t), testHostKey(t)
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+
+	// steps run in order against the same known_hosts file
+	tests := []struct {
+		name    string
+		hosts   *knownHosts
+		key     ssh.PublicKey
+		forget  bool
+		changed bool
+	}{
+		{name: "unknown key is trusted on first use", hosts: web, key: first},
+		{name: "recorded key", hosts: web, key: first},
+		{name: "changed key is rejected", hosts: web, key: second, changed: true},
+		{name: "other node has its own key", hosts: db, key: second},
+		{name: "jump host is recorded by its address", hosts: bastion, key: second},
+		{name: "changed key of jump host is rejected", hosts: bastion, key: first, changed: true},
+		{name: "forgetting node", hosts: web, forget: true},
+		{name: "forgotten node is trusted on first use again", hosts: web, key: second},
+		{name: "other hosts are kept", hosts: db, key: first, changed: true},
+		{name: "jump host is kept", hosts: bastion, key: second},
+	}
+
+	for _, test := range tests {
+		var err error
+		if test.forget {
+			err = test.hosts.forget()
+		} else {
+			err = test.hosts.check(test.hosts.alias, remote, test.key)
+		}
+		var keyErr *hostKeyError
+		if test.changed && !errors.As(err, &keyErr) {
+			t.Fatalf("%s: error %v, expected host key error", test.name, err)
+		} else if !test.changed && err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+	}
+}
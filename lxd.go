@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/koding/vagrantutil"
+)
+
+func init() {
+	registerProvider("lxd", newLxdProvider)
+	registerProvider("incus", newLxdProvider)
+}
+
+// lxdProvider runs nodes as system containers, incus shares the same cli
+type lxdProvider struct {
+	project *project
+	binary  string
+	// ansible connection plugin
+	connection string
+}
+
+func newLxdProvider(p *project, name string) (provider Provider, err error) {
+	l := &lxdProvider{project: p, binary: "lxc", connection: "community.general.lxd"}
+	if name == "incus" {
+		l.binary, l.connection = "incus", "community.general.incus"
+	}
+	if err = execInstalled(l.binary, "version"); err != nil {
+		return
+	}
+	return l, nil
+}
+
+func (l *lxdProvider) run(node *nodeType, args ...string) error {
+	cmd := exec.Command(l.binary, args...)
+	cmd.Stdout = node.outWriter()
+	cmd.Stderr = node.errWriter()
+	return cmd.Run()
+}
+
+// lxd instance states
+var lxdStates = map[string]vagrantutil.Status{
+	"RUNNING":  vagrantutil.Running,
+	"STOPPED":  vagrantutil.PowerOff,
+	"FROZEN":   vagrantutil.Saved,
+	"ERROR":    vagrantutil.Aborted,
+	"STARTING": vagrantutil.Preparing,
+}
+
+func (l *lxdProvider) Status(node *nodeType) (status vagrantutil.Status, err error) {
+	out, err := exec.Command(l.binary, "list", fmt.Sprintf("^%s$", l.project.instanceName(node)), "--format", "csv", "--columns", "s").Output()
+	if err != nil {
+		return vagrantutil.Unknown, err
+	}
+	state := strings.TrimSpace(string(out))
+	if state == "" {
+		return vagrantutil.NotCreated, nil
+	}
+	if status, ok := lxdStates[state]; ok {
+		return status, nil
+	}
+	return vagrantutil.Unknown, nil
+}
+
+// adds disk devices for synced folders and proxy devices for forwarded ports
+func (l *lxdProvider) addDevices(node *nodeType) (err error) {
+	name := l.project.instanceName(node)
+
+	nodeDir, err := filepath.Abs(l.project.nodeDir(node))
+	if err != nil {
+		return
+	}
+	folders := append([]string{nodeDir + ":/clover"}, node.Provider.SyncedFolders...)
+	for i, folder := range folders {
+		dirs, err := resolveDir(folder)
+		if err != nil {
+			return err
+		}
+		device := fmt.Sprintf("clover-disk%d", i)
+		if err = l.run(node, "config", "device", "add", name, device, "disk", "source="+dirs[0], "path="+dirs[1]); err != nil {
+			return err
+		}
+	}
+
+	// <host>:<guest>:<protocol> or <host_ip>:<host>:<guest_ip>:<guest>:<protocol>
+	for i, port := range node.Provider.Network.ForwardedPort {
+		var listen, connect string
+		list := strings.Split(port, ":")
+		switch len(list) {
+		case 3:
+			listen = fmt.Sprintf("%s:127.0.0.1:%s", list[2], list[0])
+			connect = fmt.Sprintf("%s:127.0.0.1:%s", list[2], list[1])
+		case 5:
+			listen = fmt.Sprintf("%s:%s:%s", list[4], list[0], list[1])
+			connect = fmt.Sprintf("%s:%s:%s", list[4], list[2], list[3])
+		default:
+			return fmt.Errorf("Cannot parse forwarded port %s", port)
+		}
+		device := fmt.Sprintf("clover-port%d", i)
+		if err = l.run(node, "config", "device", "add", name, device, "proxy", "listen="+listen, "connect="+connect); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// initializes instance with devices and starts it
+func (l *lxdProvider) Create(node *nodeType) (err error) {
+	if err = os.MkdirAll(l.project.nodeDir(node), 0755); err != nil {
+		return
+	}
+
+	name := l.project.instanceName(node)
+	status, err := l.Status(node)
+	if err != nil {
+		return
+	}
+	switch status {
+	case vagrantutil.Running:
+		return
+	case vagrantutil.NotCreated:
+		args := []string{"init", node.Provider.Image, name}
+		if node.Provider.Privileged {
+			args = append(args, "--config", "security.privileged=true", "--config", "security.nesting=true")
+		}
+		fmt.Fprintln(node.outWriter(), l.binary, strings.Join(args, " "))
+		if err = l.run(node, args...); err != nil {
+			return
+		}
+		if err = l.addDevices(node); err != nil {
+			return
+		}
+	case vagrantutil.PowerOff:
+	default:
+		return fmt.Errorf("State is %s, destroy and run converge again", status)
+	}
+
+	if err = l.run(node, "start", name); err != nil {
+		return
+	}
+
+	// exec is refused until instance init is up
+	for i := 0; i < 60; i++ {
+		if exec.Command(l.binary, "exec", name, "--", "true").Run() == nil {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("node %s did not start", node.Name)
+}
+
+func (l *lxdProvider) Halt(node *nodeType) error {
+	return l.run(node, "stop", l.project.instanceName(node))
+}
+
+func (l *lxdProvider) Destroy(node *nodeType) (err error) {
+	status, err := l.Status(node)
+	if err != nil || status == vagrantutil.NotCreated {
+		return
+	}
+	return l.run(node, "delete", "--force", l.project.instanceName(node))
+}
+
+func (l *lxdProvider) Connect(node *nodeType) (Transport, error) {
+	return newExecTransport(l.binary, "exec", l.project.instanceName(node), "--"), nil
+}
+
+// ansible reaches instance with lxd/incus connection plugin from community.general
+func (l *lxdProvider) Address(node *nodeType) (sshItems, error) {
+	return sshItems{Host: l.project.instanceName(node), Connection: l.connection}, nil
+}
+
+func (l *lxdProvider) Login(node *nodeType) error {
+	cmd := exec.Command(l.binary, "exec", l.project.instanceName(node), "--",
+		"sh", "-c", "command -v bash >/dev/null && exec bash || exec sh")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -1,86 +1,216 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
 
 	"github.com/docopt/docopt-go"
-	"github.com/koding/vagrantutil"
-	yaml "gopkg.in/yaml.v2"
 )
 
+// desc tags are descriptions of configuration keys used in json schema, see schema.go
 type configType struct {
-	Nodes []nodeType `yaml:"nodes"`
+	Project     string         `yaml:"project" desc:"project name, state directory is .<project>, required when configuration is combined from several files"`
+	Include     []string       `yaml:"include" desc:"configuration files merged before this one, relative to this file"`
+	Nodes       []nodeType     `yaml:"nodes" desc:"virtual machines definitions"`
+	Defaults    nodeType       `yaml:"defaults" desc:"node settings deep merged into every node, node values override them" schema:"partial"`
+	Platforms   []platformType `yaml:"platforms" desc:"provider settings every suite is tested on, each suite and platform combination becomes node <suite>-<platform>"`
+	Suites      []suiteType    `yaml:"suites" desc:"provisioners, files and verifier tested on every platform"`
+	Provisioner []Provisioner  `yaml:"provisioner" desc:"top level ansible provisioners run against all nodes at once after every node was converged"`
 }
 
 type Provisioner struct {
-	Name      string   `yaml:"name"`
-	Playbook  string   `yaml:"playbook"`
-	Content   string   `yaml:"content"`
-	RunOnce   bool     `yaml:"run_once"`
-	Groups    []string `yaml:"groups"`
-	Extravars []string `yaml:"extra_vars"`
+	Name          string   `yaml:"name" desc:"provisioner name" schema:"required" enum:"ansible,ansible-local,shell"`
+	ID            string   `yaml:"id,omitempty" desc:"stable identifier of the provisioner in state, run_once and skip_unchanged provisioners without it are identified by their definition"`
+	Playbook      string   `yaml:"playbook" desc:"ansible playbook path, relative to configuration file for ansible, absolute inside the virtual machine for ansible-local"`
+	Content       string   `yaml:"content" desc:"shell commands to be run during converge phase"`
+	RunOnce       bool     `yaml:"run_once" desc:"provisioner runs only on first successful converge of the node"`
+	SkipUnchanged bool     `yaml:"skip_unchanged" desc:"provisioner is skipped if neither its definition nor local files it uses changed since its last successful run"`
+	Groups        []string `yaml:"groups" desc:"ansible inventory groups the node belongs to"`
+	Extravars     []string `yaml:"extra_vars" desc:"ansible --extra-vars values"`
 }
 
 type File struct {
-	Path    string `yaml:"path"`
-	Mode    uint32 `mode:"mode"`
-	Content string `yaml:"content"`
-	User    string `yaml:"user"`
-	Group   string `yaml:"group"`
+	Path    string `yaml:"path" desc:"absolute path inside virtual machine" schema:"required"`
+	Mode    uint32 `yaml:"mode" desc:"octal file mode, e.g. 0600"`
+	Content string `yaml:"content" desc:"file content"`
+	User    string `yaml:"user" desc:"file owner, group must be set too"`
+	Group   string `yaml:"group" desc:"file group, user must be set too"`
+}
+
+type providerType struct {
+	Name          string                            `yaml:"name" desc:"provider name, built in or clover-provider-<name> plugin, required unless set by defaults, extends or platform"`
+	Box           string                            `yaml:"box" desc:"vagrant box name, debootstrap suite for nspawn"`
+	BoxVersion    string                            `yaml:"box_version" desc:"vagrant box version constraint, e.g. = 20230607.0.0"`
+	BoxURL        string                            `yaml:"box_url" desc:"url or path vagrant box is downloaded from"`
+	Cpus          int                               `yaml:"cpus" desc:"number of cpus of vagrant and qemu vm"`
+	Memory        int                               `yaml:"memory" desc:"memory of vagrant and qemu vm in megabytes"`
+	Disks         []diskType                        `yaml:"disks" desc:"additional vagrant vm disks"`
+	Customize     map[string]map[string]interface{} `yaml:"customize" desc:"vagrant provider settings keyed by vagrant provider name, e.g. virtualbox or libvirt, set in its node.vm.provider block"`
+	Image         string                            `yaml:"image" desc:"container image for docker/podman, instance image for lxd/incus, rootfs tarball for nspawn, qcow2 cloud image for qemu"`
+	Command       string                            `yaml:"command" desc:"docker/podman command to keep container running instead of image default"`
+	Privileged    bool                              `yaml:"privileged" desc:"runs privileged docker/podman container, privileged and nested lxd/incus instance"`
+	Options       map[string]interface{}            `yaml:"options" desc:"options passed as is to provider plugin"`
+	SyncedFolders []string                          `yaml:"synced_folders" desc:"local directories mounted into virtual machine, <host dir>:<absolute vm dir>"`
+	Network       struct {
+		ForwardedPort  []string             `yaml:"forwarded_port" desc:"host ports forwarded to vm ports, <host port>:<vm port>:<protocol> or <host ip>:<host port>:<vm ip>:<vm port>:<protocol>"`
+		PrivateNetwork []privateNetworkType `yaml:"private_network" desc:"vagrant private networks, host-only networks nodes reach each other on"`
+		PublicNetwork  []publicNetworkType  `yaml:"public_network" desc:"vagrant public networks, bridged to host interface"`
+	} `yaml:"network" desc:"network settings"`
+}
+
+type privateNetworkType struct {
+	IP string `yaml:"ip" desc:"static ip address, assigned by dhcp if not set"`
+}
+
+type publicNetworkType struct {
+	IP     string `yaml:"ip" desc:"static ip address, assigned by dhcp if not set"`
+	Bridge string `yaml:"bridge" desc:"host interface the network is bridged to, vagrant asks if not set"`
+}
+
+type diskType struct {
+	Name string `yaml:"name" desc:"disk name" schema:"required"`
+	Size string `yaml:"size" desc:"disk size in MB, GB or TB, e.g. 20GB" schema:"required"`
+}
+
+type verifierType struct {
+	Name     string `yaml:"name" desc:"verifier name" enum:"goss"`
+	GossFile string `yaml:"goss_file" desc:"absolute path to the goss file inside vm"`
+}
+
+type sshType struct {
+	Host           string `yaml:"host" desc:"hostname or ip address of static node"`
+	User           string `yaml:"user" desc:"ssh user, defaults to current user, must be able to run sudo without password"`
+	Port           int    `yaml:"port" desc:"ssh port, defaults to 22"`
+	IdentityFile   string `yaml:"identity_file" desc:"private key, defaults to ~/.ssh/id_rsa, encrypted key passphrase is read from CLOVER_SSH_PASSPHRASE or asked for"`
+	Password       string `yaml:"password" desc:"static node password, tried after private key and ssh agent keys"`
+	ProxyJump      string `yaml:"proxy_jump" desc:"static node jump host, [<user>@]<host>[:<port>] or comma separated chain of them, authenticated the same way as the node"`
+	Timeout        int    `yaml:"timeout" desc:"seconds to wait for ssh to become available, defaults to 300"`
+	Retries        int    `yaml:"retries" desc:"connection attempts before giving up, unlimited within timeout by default"`
+	ConnectTimeout int    `yaml:"connect_timeout" desc:"seconds single connection attempt may take, defaults to 10"`
 }
 
 type nodeType struct {
-	Name     string `yaml:"name"`
-	Provider struct {
-		Name          string   `yaml:"name"`
-		Box           string   `yaml:"box"`
-		SyncedFolders []string `yaml:"synced_folders"`
-		Network       struct {
-			ForwardedPort []string `yaml:"forwarded_port"`
-		} `yaml:"network"`
-	} `yaml:"provider"`
-	Provisioner []Provisioner `yaml:"provisioner"`
-	Verifier    struct {
-		Name     string `yaml:"name"`
-		GossFile string `yaml:"goss_file"`
-	} `yaml:"verifier"`
-	Files []File `yaml:"files"`
-	SSH   struct {
-		Host         string
-		User         string
-		Port         int
-		IdentityFile string
-	}
+	Name        string        `yaml:"name" desc:"virtual machine name" schema:"required"`
+	Extends     string        `yaml:"extends" desc:"name of node whose settings are deep merged into this node, node values override them"`
+	Provider    providerType  `yaml:"provider" desc:"provider section, applied during converge phase, required unless set by defaults or extends"`
+	Provisioner []Provisioner `yaml:"provisioner" desc:"provisioners applied during converge phase"`
+	Verifier    verifierType  `yaml:"verifier" desc:"verifier applied during verify phase"`
+	Files       []File        `yaml:"files" desc:"files uploaded into virtual machine during converge phase, existing files are kept"`
+	SSH         sshType       `yaml:"ssh" desc:"connection details of already running machine for static provider"`
+
+	// output of the node, see outWriter and errWriter
+	stdout, stderr io.Writer
 }
 
-func (c *configType) Parse(data []byte) error {
-	return yaml.Unmarshal(data, c)
+// platformType is node provider part, combined with every suite
+type platformType struct {
+	Name     string       `yaml:"name" desc:"platform name, second part of generated node names" schema:"required"`
+	Provider providerType `yaml:"provider" desc:"provider section of generated nodes" schema:"required"`
+	SSH      sshType      `yaml:"ssh" desc:"connection details of generated nodes for static provider"`
 }
 
-var (
-	conf       configType
-	vagrantDir string
-	configFile string
-)
+// suiteType is node provisioning part, combined with every platform
+type suiteType struct {
+	Name        string        `yaml:"name" desc:"suite name, first part of generated node names" schema:"required"`
+	Provisioner []Provisioner `yaml:"provisioner" desc:"provisioners of generated nodes"`
+	Verifier    verifierType  `yaml:"verifier" desc:"verifier of generated nodes"`
+	Files       []File        `yaml:"files" desc:"files uploaded into generated nodes"`
+	Includes    []string      `yaml:"includes" desc:"platforms the suite is tested on, all platforms if empty"`
+	Excludes    []string      `yaml:"excludes" desc:"platforms the suite is not tested on"`
+}
 
 func writeFile(filename string, content string) (err error) {
 	err = ioutil.WriteFile(filename, []byte(content), 0644)
 	return
 }
 
-// reads and parses config file
-func getConf(configFile string) (config configType, err error) {
-	data, err := ioutil.ReadFile(configFile)
+// renders text template with data
+func renderTemplate(text string, data interface{}) (content string, err error) {
+	tpl, err := template.New("").Parse(text)
 	if err != nil {
 		return
 	}
-	config.Parse(data)
+	var buf bytes.Buffer
+	if err = tpl.Execute(&buf, data); err != nil {
+		return
+	}
+	return buf.String(), nil
+}
+
+// returns lines removed from a prefixed with "-" and lines added in b prefixed with "+",
+// unchanged lines around them are prefixed with " "
+func lineDiff(a, b string) string {
+	linesA, linesB := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	// longest common subsequence of lines, lcs[i][j] is for linesA[i:] and linesB[j:]
+	lcs := make([][]int, len(linesA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(linesB)+1)
+	}
+	for i := len(linesA) - 1; i >= 0; i-- {
+		for j := len(linesB) - 1; j >= 0; j-- {
+			if linesA[i] == linesB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(linesA) || j < len(linesB) {
+		switch {
+		case i < len(linesA) && j < len(linesB) && linesA[i] == linesB[j]:
+			diff = append(diff, " "+linesA[i])
+			i, j = i+1, j+1
+		case i < len(linesA) && (j == len(linesB) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+linesA[i])
+			i++
+		default:
+			diff = append(diff, "+"+linesB[j])
+			j++
+		}
+	}
+
+	// unchanged lines more than 2 lines away from changes are skipped
+	var out bytes.Buffer
+	skipped := false
+	for k, line := range diff {
+		near := false
+		for l := k - 2; l <= k+2; l++ {
+			if l >= 0 && l < len(diff) && diff[l][0] != ' ' {
+				near = true
+			}
+		}
+		if !near {
+			skipped = true
+			continue
+		}
+		if skipped {
+			out.WriteString("...\n")
+			skipped = false
+		}
+		out.WriteString(line + "\n")
+	}
+	return out.String()
+}
+
+// reads, merges and validates config files, templated config files are rendered first
+func getConf(configFiles []string, templated bool) (config configType, err error) {
+	err = loadConfig(configFiles, templated, &config)
 	return
 }
 
@@ -110,115 +240,148 @@ func getConfigFileNoExt(configFile string) (ConfigFileNoExt string, err error) {
 	return
 }
 
-func converge(node *nodeType, configFile string) (err error) {
-	if node.Provider.Name == "vagrant" {
-		if err = convergeVagrant(node, configFile); err != nil {
-			return
-		}
-	} else {
-		err = fmt.Errorf("provider %s for node %s is not supported", node.Provider.Name, node.Name)
-	}
-	return
-}
-
-func sshNode1(node *nodeType, vmName string, configFile string) (err error) {
-	if node.Provider.Name == "vagrant" {
-		if err = sshVagrant(vmName, configFile); err != nil {
-			return
-		}
-	} else {
-		err = fmt.Errorf("provider %s for node %s is not supported", node.Provider.Name, node.Name)
+// exits if err is not nil
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
 	}
-	return
-
 }
 
 func main() {
 	usage := `
-usage: [-h] <command> [<config> <vm_name>]
+usage: [-h] <command> [<config> <vm_name>] [-f <file>]... [--destroy=<mode>] [--concurrency=<n>] [--reload] [--template]
 
 commands:
-    converge            bootstraps virtual machine and applies playbook
+    converge            bootstraps virtual machine or container and applies playbook
     destroy             destroys virtual machine
+    halt                stops virtual machine
     status              checks status of virtual machine
     verify              runs one of the verifiers against the virtual machine
-	ssh                 ssh into virtual machine`
+    ssh                 ssh into virtual machine
+    test                converges, verifies and destroys virtual machine
+    validate            checks configuration file
+    schema              prints json schema of configuration file
+
+options:
+    -f <file>           configuration file merged over previous ones, may be repeated
+    --destroy=<mode>    test: destroy nodes always, passing (only nodes that passed) or never [default: passing]
+    --concurrency=<n>   converge, verify, test: number of nodes processed at once [default: 1]
+    --reload            regenerate Vagrantfile changed in configuration and reload affected nodes
+    --template          render configuration file as go template before parsing it`
 
 	arguments, _ := docopt.ParseDoc(usage)
 	command := arguments["<command>"]
 	configFile := arguments["<config>"]
 	vmName := arguments["<vm_name>"]
 
-	if configFile == nil {
-		configFile = "clover.yml"
+	// schema does not need configuration file
+	if command == "schema" {
+		schema, err := configSchema()
+		exitOnError(err)
+		fmt.Println(string(schema))
+		return
 	}
 
-	conf, err := getConf(configFile.(string))
-	if err != nil {
-		fmt.Println("Error:", err)
-		os.Exit(1)
+	// with -f single positional argument is base file only if it looks like one, otherwise it is vm name
+	// and overlays are merged over clover.yml
+	configFiles := arguments["-f"].([]string)
+	if configFile != nil && (len(configFiles) == 0 || vmName != nil || strings.HasSuffix(configFile.(string), ".yml")) {
+		configFiles = append([]string{configFile.(string)}, configFiles...)
+	} else {
+		if len(configFiles) > 0 {
+			if _, err := os.Stat("clover.yml"); os.IsNotExist(err) {
+				exitOnError(errors.New("-f files are merged over clover.yml which does not exist, give base configuration file as the first argument"))
+			}
+		}
+		if configFile != nil {
+			vmName = configFile
+		}
+		configFiles = append([]string{"clover.yml"}, configFiles...)
 	}
-	vagrantDir, err := getVagrantDir(configFile.(string))
-	if err != nil {
-		fmt.Println("Error:", err)
-		os.Exit(1)
+
+	conf, err := getConf(configFiles, arguments["--template"].(bool))
+	exitOnError(err)
+	if command == "validate" {
+		fmt.Println("Configuration is valid")
+		return
 	}
+	vagrantDir, err := getStateDir(&conf, configFiles)
+	exitOnError(err)
 
-	err = execInstalled("vagrant", "version")
-	if err != nil {
-		fmt.Println("Error:", err)
-		os.Exit(1)
+	p := &project{conf: &conf, configFile: strings.Join(configFiles, ", "), configDir: filepath.Dir(configFiles[0]), stateDir: vagrantDir,
+		longLived: command == "converge" || command == "verify" || command == "test"}
+	// connections to the nodes are closed once the command is done, exit on error leaves it to the system
+	defer p.closeTransports()
+
+	// nodes the command is applied to
+	nodes := conf.Nodes
+	if vmName != nil {
+		node, err := getNodeConf(&conf, vmName.(string))
+		exitOnError(err)
+		nodes = []nodeType{node}
 	}
 
-	if command == "converge" {
+	concurrency, err := strconv.Atoi(arguments["--concurrency"].(string))
+	if err != nil || concurrency < 1 {
+		exitOnError(fmt.Errorf("concurrency must be positive number"))
+	}
 
-		if vmName != nil {
-			node, err := getNodeConf(&conf, vmName.(string))
-			if err != nil {
-				fmt.Println("Error:", err)
-				os.Exit(1)
-			}
-			if err = converge(&node, configFile.(string)); err != nil {
-				fmt.Println("Error:", err)
-				os.Exit(1)
-			}
-		} else {
-			for _, node := range conf.Nodes {
-				if err = converge(&node, configFile.(string)); err != nil {
-					fmt.Println("Error:", err)
-					os.Exit(1)
-				}
-				fmt.Println("*** Converged node", node.Name)
-			}
-		}
+	// providers of all nodes must be available
+	for _, node := range nodes {
+		_, err = p.provider(&node)
+		exitOnError(err)
 	}
 
-	if command == "status" {
-		vagrant, _ := vagrantutil.NewVagrant(vagrantDir)
+	// generated files must match configuration, status and destroy work with what exists
+	if command != "status" && command != "destroy" {
+		exitOnError(p.checkDrift(nodes, arguments["--reload"].(bool)))
+	}
 
-		status, err := vagrant.Status()
-		if err != nil {
-			fmt.Println("Error:", err)
+	if command == "converge" {
+		results := runNodes(nodes, concurrency, func(node *nodeType) nodeResult {
+			if err := converge(p, node); err != nil {
+				return nodeResult{stage: "converge", err: err}
+			}
+			fmt.Fprintln(node.outWriter(), "*** Converged node", node.Name)
+			return nodeResult{}
+		})
+		if printSummary(results) > 0 {
 			os.Exit(1)
 		}
 
-		fmt.Println(status)
+		// cluster wide playbooks need every node
+		if vmName == nil {
+			exitOnError(provisionAll(p))
+		}
 	}
 
-	if command == "destroy" {
-		vagrant, _ := vagrantutil.NewVagrant(vagrantDir)
+	if command == "status" {
+		exitOnError(printStatus(p, nodes))
+	}
 
-		if status, _ := vagrant.Status(); status != vagrantutil.Running {
-			fmt.Println("Error: vm is not running, current status:", status)
-			os.Exit(1)
+	if command == "halt" {
+		for _, node := range nodes {
+			// static machine is not managed by clover, other nodes are still halted
+			if node.Provider.Name == "static" {
+				fmt.Println("*** Skipping static node", node.Name+", it cannot be halted")
+				continue
+			}
+			provider, _ := p.provider(&node)
+			exitOnError(provider.Halt(&node))
+			fmt.Println("*** Halted node", node.Name)
 		}
-		output, _ := vagrant.Destroy()
-		for line := range output {
-			log.Println(line.Line)
+	}
+
+	if command == "destroy" {
+		for _, node := range nodes {
+			exitOnError(destroy(p, &node))
 		}
-		if err := os.RemoveAll(vagrantDir); err != nil {
-			fmt.Println("Failed to remove", vagrantDir)
-			os.Exit(1)
+		if vmName == nil {
+			if err := p.removeStateDir(); err != nil {
+				fmt.Println("Failed to remove", vagrantDir)
+				os.Exit(1)
+			}
 		}
 		fmt.Println("Successfully destroyed")
 	}
@@ -229,41 +392,33 @@ commands:
 			os.Exit(1)
 		}
 
-		node, err := getNodeConf(&conf, vmName.(string))
-		if err != nil {
-			fmt.Println("Error:", err)
-			os.Exit(1)
-		}
-
-		err = sshNode1(&node, vmName.(string), configFile.(string))
-		if err != nil {
-			fmt.Println("Error:", err)
-			os.Exit(1)
-		}
+		provider, _ := p.provider(&nodes[0])
+		exitOnError(provider.Login(&nodes[0]))
 	}
 
 	if command == "verify" {
-
-		if vmName != nil {
-			fmt.Println("Verifying node", vmName)
-			node, err := getNodeConf(&conf, vmName.(string))
-			if err != nil {
-				fmt.Println("Error:", err)
-				os.Exit(1)
+		results := runNodes(nodes, concurrency, func(node *nodeType) nodeResult {
+			if node.Verifier.Name == "" {
+				fmt.Fprintln(node.outWriter(), "No verifier defined for node", node.Name)
+				return nodeResult{skipped: "verify"}
 			}
-			if err = node.verify(vagrantDir); err != nil {
-				fmt.Println("Error:", err)
-				os.Exit(1)
-			}
-		} else {
-			for _, node := range conf.Nodes {
-				fmt.Println("Verifying node", node.Name)
-				if err = node.verify(vagrantDir); err != nil {
-					fmt.Println("Error:", err)
-					os.Exit(1)
-				}
-				fmt.Println("*** Verified node", node.Name)
+			fmt.Fprintln(node.outWriter(), "Verifying node", node.Name)
+			if err := node.verify(p); err != nil {
+				return nodeResult{stage: "verify", err: err}
 			}
+			fmt.Fprintln(node.outWriter(), "*** Verified node", node.Name)
+			return nodeResult{}
+		})
+		if printSummary(results) > 0 {
+			os.Exit(1)
+		}
+	}
+
+	if command == "test" {
+		results, err := runTests(p, nodes, vmName == nil, arguments["--destroy"].(string), concurrency)
+		exitOnError(err)
+		if printSummary(results) > 0 {
+			os.Exit(1)
 		}
 	}
 
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     string
+		expected []string
+	}{
+		{
+			name: "same",
+			a:    "a\nb\nc",
+			b:    "a\nb\nc",
+		},
+		{
+			name:     "changed line",
+			a:        "a\nb\nc",
+			b:        "a\nx\nc",
+			expected: []string{" a", "-b", "+x", " c"},
+		},
+		{
+			name:     "added and removed lines",
+			a:        "a\nb\nc",
+			b:        "b\nc\nd",
+			expected: []string{"-a", " b", " c", "+d"},
+		},
+		{
+			name:     "distant unchanged lines are skipped",
+			a:        "1\n2\n3\n4\n5\n6\n7\n8",
+			b:        "1\n2\n3\n4\n5\n6\n7\n9",
+			expected: []string{"...", " 6", " 7", "-8", "+9"},
+		},
+		{
+			name:     "unchanged lines between distant changes are skipped",
+			a:        "1\n2\n3\n4\n5\n6\n7\n8\n9",
+			b:        "x\n2\n3\n4\n5\n6\n7\n8\ny",
+			expected: []string{"-1", "+x", " 2", " 3", "...", " 7", " 8", "-9", "+y"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expected := ""
+			if len(test.expected) > 0 {
+				expected = strings.Join(test.expected, "\n") + "\n"
+			}
+			if diff := lineDiff(test.a, test.b); diff != expected {
+				t.Errorf("diff\n%s\nexpected\n%s", diff, expected)
+			}
+		})
+	}
+}
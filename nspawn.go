@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/koding/vagrantutil"
+)
+
+func init() {
+	registerProvider("nspawn", newNspawnProvider)
+}
+
+// nspawnProvider boots rootfs unpacked into .<stateDir>/<node>/rootfs with systemd-nspawn,
+// rootfs comes from provider.image tarball or debootstrap of provider.box suite
+type nspawnProvider struct {
+	project *project
+}
+
+func newNspawnProvider(p *project, name string) (provider Provider, err error) {
+	for _, executable := range []string{"systemd-nspawn", "systemd-run", "machinectl", "nsenter"} {
+		if err = execInstalled(executable, "--version"); err != nil {
+			return
+		}
+	}
+	return &nspawnProvider{project: p}, nil
+}
+
+func (n *nspawnProvider) rootfs(node *nodeType) string {
+	rootfs, _ := filepath.Abs(filepath.Join(n.project.nodeDir(node), "rootfs"))
+	return rootfs
+}
+
+func (n *nspawnProvider) run(node *nodeType, args ...string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = node.outWriter()
+	cmd.Stderr = node.errWriter()
+	return cmd.Run()
+}
+
+// returns machine property from machinectl
+func (n *nspawnProvider) property(node *nodeType, property string) (value string, err error) {
+	out, err := exec.Command("machinectl", "show", n.project.instanceName(node), "--property", property, "--value").Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func (n *nspawnProvider) Status(node *nodeType) (vagrantutil.Status, error) {
+	if state, err := n.property(node, "State"); err == nil {
+		if state == "running" {
+			return vagrantutil.Running, nil
+		}
+		return vagrantutil.Preparing, nil
+	}
+	if _, err := os.Stat(n.rootfs(node)); err == nil {
+		return vagrantutil.PowerOff, nil
+	}
+	return vagrantutil.NotCreated, nil
+}
+
+// unpacks tarball or runs debootstrap into rootfs
+func (n *nspawnProvider) prepare(node *nodeType) (err error) {
+	rootfs := n.rootfs(node)
+	tmp := rootfs + ".tmp"
+	if err = os.RemoveAll(tmp); err != nil {
+		return
+	}
+	if err = os.MkdirAll(tmp, 0755); err != nil {
+		return
+	}
+
+	if node.Provider.Image != "" {
+		image, err := filepath.Abs(node.Provider.Image)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(node.outWriter(), "Unpacking", image, "into", rootfs)
+		if err = n.run(node, "tar", "--extract", "--numeric-owner", "--file", image, "--directory", tmp); err != nil {
+			return err
+		}
+	} else {
+		if err = execInstalled("debootstrap", ""); err != nil {
+			return
+		}
+		fmt.Fprintln(node.outWriter(), "Bootstrapping", node.Provider.Box, "into", rootfs)
+		if err = n.run(node, "debootstrap", "--include=systemd,dbus,sudo", node.Provider.Box, tmp); err != nil {
+			return
+		}
+	}
+
+	if err = writeFile(filepath.Join(tmp, "etc", "hostname"), node.Name+"\n"); err != nil {
+		return
+	}
+
+	// empty machine-id is generated by systemd on first boot
+	if _, statErr := os.Stat(filepath.Join(tmp, "etc", "machine-id")); os.IsNotExist(statErr) {
+		if err = writeFile(filepath.Join(tmp, "etc", "machine-id"), ""); err != nil {
+			return
+		}
+	}
+	return os.Rename(tmp, rootfs)
+}
+
+// boots the machine as transient unit, synced folders are bind mounted
+func (n *nspawnProvider) Create(node *nodeType) (err error) {
+	if err = os.MkdirAll(n.project.nodeDir(node), 0755); err != nil {
+		return
+	}
+
+	status, err := n.Status(node)
+	if err != nil || status == vagrantutil.Running {
+		return
+	}
+	if status == vagrantutil.NotCreated {
+		if err = n.prepare(node); err != nil {
+			return
+		}
+	}
+
+	name := n.project.instanceName(node)
+	nodeDir, err := filepath.Abs(n.project.nodeDir(node))
+	if err != nil {
+		return
+	}
+	args := []string{"systemd-run", "--unit", name, "--property", "KillMode=mixed", "--property", "Type=notify",
+		"systemd-nspawn", "--quiet", "--keep-unit", "--boot", "--notify-ready=yes",
+		"--machine", name, "--directory", n.rootfs(node),
+		"--bind", nodeDir + ":/clover",
+	}
+	for _, folder := range node.Provider.SyncedFolders {
+		dirs, err := resolveDir(folder)
+		if err != nil {
+			return err
+		}
+		args = append(args, "--bind", fmt.Sprintf("%s:%s", dirs[0], dirs[1]))
+	}
+	fmt.Fprintln(node.outWriter(), strings.Join(args, " "))
+	if err = n.run(node, args...); err != nil {
+		return
+	}
+
+	for i := 0; i < 60; i++ {
+		if status, _ := n.Status(node); status == vagrantutil.Running {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("node %s did not boot", node.Name)
+}
+
+func (n *nspawnProvider) Halt(node *nodeType) error {
+	if status, _ := n.Status(node); status != vagrantutil.Running {
+		return nil
+	}
+	return n.run(node, "machinectl", "poweroff", n.project.instanceName(node))
+}
+
+// terminates the machine and waits until it is gone, node directory with rootfs is removed afterwards
+func (n *nspawnProvider) Destroy(node *nodeType) (err error) {
+	name := n.project.instanceName(node)
+	if _, err := n.property(node, "State"); err == nil {
+		if err = n.run(node, "machinectl", "terminate", name); err != nil {
+			return err
+		}
+		for i := 0; ; i++ {
+			if _, err := n.property(node, "State"); err != nil {
+				break
+			}
+			if i == 60 {
+				return fmt.Errorf("node %s did not stop", node.Name)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	// terminated transient unit stays loaded as failed, systemd-run of the next converge would fail;
+	// unit which is not loaded is an error, it is ignored
+	exec.Command("systemctl", "reset-failed", name+".service").Run()
+	return
+}
+
+// commands enter namespaces of machine init process
+func (n *nspawnProvider) Connect(node *nodeType) (Transport, error) {
+	leader, err := n.property(node, "Leader")
+	if err != nil {
+		return nil, fmt.Errorf("node %s is not running", node.Name)
+	}
+	return newExecTransport("nsenter", "--target", leader, "--mount", "--uts", "--ipc", "--net", "--pid", "--root", "--wd", "--"), nil
+}
+
+// ansible runs inside rootfs with chroot connection plugin
+func (n *nspawnProvider) Address(node *nodeType) (sshItems, error) {
+	return sshItems{Host: n.rootfs(node), Connection: "community.general.chroot"}, nil
+}
+
+func (n *nspawnProvider) Login(node *nodeType) error {
+	cmd := exec.Command("machinectl", "shell", n.project.instanceName(node))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
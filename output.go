@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// serializes lines written by concurrently running nodes
+var outputMutex sync.Mutex
+
+// prefixWriter writes every complete line prefixed with node name, partial line is kept until newline or flush
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	// guards buf, stdout and stderr of a command are copied concurrently
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newPrefixWriter(w io.Writer, name string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: fmt.Sprintf("[%s] ", name)}
+}
+
+func (pw *prefixWriter) Write(p []byte) (n int, err error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.buf.Write(p)
+	for {
+		i := bytes.IndexByte(pw.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		if err = pw.writeLine(pw.buf.Next(i + 1)); err != nil {
+			return
+		}
+	}
+	return len(p), nil
+}
+
+func (pw *prefixWriter) writeLine(line []byte) (err error) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	_, err = fmt.Fprintf(pw.w, "%s%s", pw.prefix, line)
+	return
+}
+
+// writes remaining partial line
+func (pw *prefixWriter) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.buf.Len() == 0 {
+		return nil
+	}
+	return pw.writeLine(append(pw.buf.Next(pw.buf.Len()), '\n'))
+}
+
+// returns writer for node output, stdout unless nodes run concurrently
+func (node *nodeType) outWriter() io.Writer {
+	if node.stdout == nil {
+		return os.Stdout
+	}
+	return node.stdout
+}
+
+// returns writer for node errors, stderr unless nodes run concurrently
+func (node *nodeType) errWriter() io.Writer {
+	if node.stderr == nil {
+		return os.Stderr
+	}
+	return node.stderr
+}
+
+type nodeResult struct {
+	node string
+	// stage the node failed at, empty if it passed
+	stage string
+	// stage the node skipped, e.g. verify of node without verifier, it did not fail but did not pass either
+	skipped  string
+	err      error
+	duration time.Duration
+}
+
+// runs fn for every node, at most concurrency nodes at once; output of every node
+// is prefixed with its name when more than one node runs at once
+func runNodes(nodes []nodeType, concurrency int, fn func(node *nodeType) nodeResult) []nodeResult {
+	results := make([]nodeResult, len(nodes))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, node := range nodes {
+		var writers []*prefixWriter
+		if concurrency > 1 {
+			stdout, stderr := newPrefixWriter(os.Stdout, node.Name), newPrefixWriter(os.Stderr, node.Name)
+			node.stdout, node.stderr = stdout, stderr
+			writers = append(writers, stdout, stderr)
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, node nodeType) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			start := time.Now()
+			results[i] = fn(&node)
+			results[i].node = node.Name
+			results[i].duration = time.Since(start)
+			for _, w := range writers {
+				w.Flush()
+			}
+		}(i, node)
+	}
+	wg.Wait()
+	return results
+}
+
+// prints results table, returns number of failed nodes
+func printSummary(results []nodeResult) (failed int) {
+	fmt.Println("*** Summary")
+	skipped := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tRESULT\tSTAGE\tDURATION\tERROR")
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+			fmt.Fprintf(w, "%s\tfailed\t%s\t%s\t%s\n", result.node, result.stage, result.duration.Round(time.Second), result.err)
+		} else if result.skipped != "" {
+			skipped++
+			fmt.Fprintf(w, "%s\tskipped\t%s\t%s\tno verifier defined\n", result.node, result.skipped, result.duration.Round(time.Second))
+		} else {
+			fmt.Fprintf(w, "%s\tpassed\t\t%s\t\n", result.node, result.duration.Round(time.Second))
+		}
+	}
+	w.Flush()
+	fmt.Printf("%d passed, %d skipped, %d failed\n", len(results)-failed-skipped, skipped, failed)
+	return
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/koding/vagrantutil"
+)
+
+// version of the protocol spoken with provider plugins
+const pluginProtocolVersion = 1
+
+// provider plugins are executables named clover-provider-<name> found in PATH
+const pluginPrefix = "clover-provider-"
+
+// pluginProvider delegates node lifecycle to external executable, every call is
+// a single JSON-RPC 2.0 request written to its stdin and response read from its stdout
+type pluginProvider struct {
+	project *project
+	path    string
+	id      int
+}
+
+// returns provider plugin for unknown provider name, nil if there is no such executable
+func findPluginProvider(p *project, name string) Provider {
+	path, err := exec.LookPath(pluginPrefix + name)
+	if err != nil {
+		return nil
+	}
+	return &pluginProvider{project: p, path: path}
+}
+
+type pluginNode struct {
+	Name          string      `json:"name"`
+	Box           string      `json:"box,omitempty"`
+	Image         string      `json:"image,omitempty"`
+	SyncedFolders []string    `json:"synced_folders,omitempty"`
+	ForwardedPort []string    `json:"forwarded_port,omitempty"`
+	Options       interface{} `json:"options,omitempty"`
+}
+
+type pluginParams struct {
+	ProtocolVersion int        `json:"protocol_version"`
+	StateDir        string     `json:"state_dir"`
+	Node            pluginNode `json:"node"`
+}
+
+type pluginRequest struct {
+	JSONRPC string       `json:"jsonrpc"`
+	ID      int          `json:"id"`
+	Method  string       `json:"method"`
+	Params  pluginParams `json:"params"`
+}
+
+type pluginResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      int             `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// calls plugin method, result is decoded into result if it is not nil
+func (pl *pluginProvider) call(node *nodeType, method string, result interface{}) (err error) {
+	stateDir, err := filepath.Abs(pl.project.nodeDir(node))
+	if err != nil {
+		return
+	}
+	pl.id++
+	request := pluginRequest{
+		JSONRPC: "2.0",
+		ID:      pl.id,
+		Method:  method,
+		Params: pluginParams{
+			ProtocolVersion: pluginProtocolVersion,
+			StateDir:        stateDir,
+			Node: pluginNode{
+				Name:          node.Name,
+				Box:           node.Provider.Box,
+				Image:         node.Provider.Image,
+				SyncedFolders: node.Provider.SyncedFolders,
+				ForwardedPort: node.Provider.Network.ForwardedPort,
+				Options:       jsonValue(node.Provider.Options),
+			},
+		},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(pl.path)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = &stdout
+	cmd.Stderr = node.errWriter()
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %s", filepath.Base(pl.path), method, err)
+	}
+
+	var response pluginResponse
+	if err = json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return fmt.Errorf("%s %s: invalid response: %s", filepath.Base(pl.path), method, err)
+	}
+	if response.JSONRPC != "2.0" || response.ID != request.ID {
+		return fmt.Errorf("%s %s: response does not match request", filepath.Base(pl.path), method)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("%s %s: %s (code %d)", filepath.Base(pl.path), method, response.Error.Message, response.Error.Code)
+	}
+	// plugin echoes protocol version in every result, plugin of other version would be misread
+	var version struct {
+		ProtocolVersion *int `json:"protocol_version"`
+	}
+	if err = json.Unmarshal(response.Result, &version); err != nil || version.ProtocolVersion == nil {
+		return fmt.Errorf("%s %s: result must be object with protocol_version %d", filepath.Base(pl.path), method, pluginProtocolVersion)
+	}
+	if *version.ProtocolVersion != pluginProtocolVersion {
+		return fmt.Errorf("%s %s: plugin speaks protocol version %d, clover speaks %d", filepath.Base(pl.path), method, *version.ProtocolVersion, pluginProtocolVersion)
+	}
+	if result != nil {
+		err = json.Unmarshal(response.Result, result)
+	}
+	return
+}
+
+// converts yaml maps into json compatible ones
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, item := range v {
+			m[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for key, item := range v {
+			m[key] = jsonValue(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = jsonValue(item)
+		}
+		return list
+	}
+	return value
+}
+
+func (pl *pluginProvider) Create(node *nodeType) (err error) {
+	if err = os.MkdirAll(pl.project.nodeDir(node), 0755); err != nil {
+		return
+	}
+	return pl.call(node, "create", nil)
+}
+
+// plugin reports status in vagrant machine-readable vocabulary: not_created, running, poweroff, saved, aborted
+func (pl *pluginProvider) Status(node *nodeType) (vagrantutil.Status, error) {
+	var result struct {
+		Status string `json:"status"`
+	}
+	if err := pl.call(node, "status", &result); err != nil {
+		return vagrantutil.Unknown, err
+	}
+	if status, ok := vagrantStates[result.Status]; ok {
+		return status, nil
+	}
+	return vagrantutil.Unknown, nil
+}
+
+func (pl *pluginProvider) Halt(node *nodeType) error {
+	return pl.call(node, "halt", nil)
+}
+
+func (pl *pluginProvider) Destroy(node *nodeType) error {
+	return pl.call(node, "destroy", nil)
+}
+
+func (pl *pluginProvider) Connect(node *nodeType) (Transport, error) {
+	return newSSHTransport(pl.project, node, func() (sshItems, error) { return pl.Address(node) }), nil
+}
+
+func (pl *pluginProvider) Address(node *nodeType) (address sshItems, err error) {
+	var result struct {
+		Host         string `json:"host"`
+		User         string `json:"user"`
+		Port         int    `json:"port"`
+		IdentityFile string `json:"identity_file"`
+	}
+	if err = pl.call(node, "ssh-info", &result); err != nil {
+		return
+	}
+	address = sshItems{Host: result.Host, User: result.User, Port: result.Port, IdentityFile: result.IdentityFile}
+	if address.Port == 0 {
+		address.Port = 22
+	}
+	return
+}
+
+func (pl *pluginProvider) Login(node *nodeType) (err error) {
+	address, err := pl.Address(node)
+	if err != nil {
+		return
+	}
+	return sshLogin(address, pl.project.knownHosts(node))
+}
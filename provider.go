@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/koding/vagrantutil"
+)
+
+// Provider manages lifecycle of the nodes of a single kind (vagrant, docker, ...)
+type Provider interface {
+	// Create creates and boots the node, starts it if it is stopped
+	Create(node *nodeType) error
+	// Status returns state of the node in vagrant vocabulary
+	Status(node *nodeType) (vagrantutil.Status, error)
+	// Halt stops the node keeping its disks
+	Halt(node *nodeType) error
+	// Destroy removes the node and everything it created
+	Destroy(node *nodeType) error
+	// Connect returns transport used to upload files and run provisioners
+	Connect(node *nodeType) (Transport, error)
+	// Address returns connection details used by ansible inventory
+	Address(node *nodeType) (sshItems, error)
+	// Login opens interactive shell on the node
+	Login(node *nodeType) error
+}
+
+// drifter is implemented by providers which generate files from configuration, e.g. Vagrantfile
+type drifter interface {
+	// Drift compares generated files with configuration, with reload they are regenerated
+	// and affected nodes out of given ones are reloaded, otherwise difference is an error
+	Drift(nodes []nodeType, reload bool) error
+}
+
+// project is a configuration file being worked on, providers keep their state in stateDir
+type project struct {
+	conf       *configType
+	configFile string
+	// directory of the first configuration file, local paths of provisioners are relative to it
+	configDir string
+	stateDir  string
+
+	// guards files shared by nodes, e.g. Vagrantfile, and hosts
+	mu sync.Mutex
+	// inventory hosts of running nodes
+	hosts map[string]ansibleHost
+	// serialize /etc/hosts updates of every node, nodes are created concurrently, guarded by mu
+	hostsLocks map[string]*sync.Mutex
+	// guards known_hosts, see knownHosts
+	knownHostsMu sync.Mutex
+	// transports of the nodes, guarded by mu, see transport
+	transports map[string]Transport
+	// command uses transports for long, e.g. converge, idle ssh connections are kept alive
+	longLived bool
+}
+
+// returns directory of the node inside state directory, .<config>/<node>
+func (p *project) nodeDir(node *nodeType) string {
+	return filepath.Join(p.stateDir, node.Name)
+}
+
+// returns name of container or instance, <state dir without leading dot>-<node name>,
+// dots and underscores of generated node names, e.g. web-ubuntu-18.04, become dashes
+func (p *project) instanceName(node *nodeType) string {
+	name := fmt.Sprintf("%s-%s", strings.TrimPrefix(filepath.Base(p.stateDir), "."), node.Name)
+	return strings.NewReplacer(".", "-", "_", "-").Replace(name)
+}
+
+// providerFactory creates provider for a project, name is provider name from configuration
+type providerFactory func(p *project, name string) (Provider, error)
+
+var providers = map[string]providerFactory{}
+
+// registers provider under the name used in node.provider.name
+func registerProvider(name string, factory providerFactory) {
+	if _, exists := providers[name]; exists {
+		panic(fmt.Sprintf("provider %s registered twice", name))
+	}
+	providers[name] = factory
+}
+
+// returns provider responsible for the node
+func (p *project) provider(node *nodeType) (provider Provider, err error) {
+	factory, ok := providers[node.Provider.Name]
+	if !ok {
+		if provider = findPluginProvider(p, node.Provider.Name); provider != nil {
+			return
+		}
+		err = fmt.Errorf("provider %s for node %s is not supported and %s%s was not found in PATH", node.Provider.Name, node.Name, pluginPrefix, node.Provider.Name)
+		return
+	}
+	return factory(p, node.Provider.Name)
+}
+
+// checks files generated by providers of the nodes, every provider is checked once
+func (p *project) checkDrift(nodes []nodeType, reload bool) (err error) {
+	checked := map[string]bool{}
+	for i := range nodes {
+		if checked[nodes[i].Provider.Name] {
+			continue
+		}
+		checked[nodes[i].Provider.Name] = true
+
+		provider, err := p.provider(&nodes[i])
+		if err != nil {
+			return err
+		}
+		if d, ok := provider.(drifter); ok {
+			if err = d.Drift(nodes, reload); err != nil {
+				return err
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/koding/vagrantutil"
+)
+
+func init() {
+	registerProvider("qemu", newQemuProvider)
+}
+
+const qemuBinary = "qemu-system-x86_64"
+
+// user created by cloud-init inside the guest
+const qemuUser = "clover"
+
+const cloudInitUserData = `#cloud-config
+hostname: {{ .Name }}
+users:
+  - name: {{ .User }}
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    shell: /bin/bash
+    ssh_authorized_keys:
+      - {{ .PublicKey }}
+{{- if .Mounts }}
+mounts:
+{{- range .Mounts }}
+  - [{{ index . 0 }}, {{ index . 2 }}, 9p, "trans=virtio,version=9p2000.L,nofail", "0", "0"]
+{{- end }}
+{{- end }}
+`
+
+const cloudInitMetaData = `instance-id: clover-{{ .Name }}
+local-hostname: {{ .Name }}
+`
+
+// qemuProvider boots cloud images with copy-on-write overlay, guest is configured by cloud-init NoCloud seed.
+// Everything lives in .<stateDir>/<node>: disk.qcow2, seed.iso, id_ed25519, ssh_port, qemu.pid, monitor.sock
+type qemuProvider struct {
+	project *project
+}
+
+func newQemuProvider(p *project, name string) (provider Provider, err error) {
+	for _, executable := range []string{qemuBinary, "qemu-img", "ssh-keygen"} {
+		if err = execInstalled(executable, "--version"); err != nil {
+			return
+		}
+	}
+	return &qemuProvider{project: p}, nil
+}
+
+func (q *qemuProvider) path(node *nodeType, name string) string {
+	path, _ := filepath.Abs(filepath.Join(q.project.nodeDir(node), name))
+	return path
+}
+
+// returns pid of running qemu process of the node, 0 if it is not running; pid of qemu.pid may belong
+// to unrelated process after crash or host reboot, qemu of the node has its monitor socket on command line
+func (q *qemuProvider) pid(node *nodeType) int {
+	data, err := ioutil.ReadFile(q.path(node, "qemu.pid"))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return 0
+	}
+	if err = process.Signal(syscall.Signal(0)); err != nil {
+		return 0
+	}
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		// systems without procfs are trusted by signal only
+		if _, statErr := os.Stat("/proc/self"); statErr == nil {
+			return 0
+		}
+		return pid
+	}
+	if !strings.Contains(string(cmdline), q.path(node, "monitor.sock")) {
+		return 0
+	}
+	return pid
+}
+
+func (q *qemuProvider) Status(node *nodeType) (vagrantutil.Status, error) {
+	if q.pid(node) != 0 {
+		return vagrantutil.Running, nil
+	}
+	if _, err := os.Stat(q.path(node, "disk.qcow2")); err == nil {
+		return vagrantutil.PowerOff, nil
+	}
+	return vagrantutil.NotCreated, nil
+}
+
+// returns local path of provider.image, downloads it into .<stateDir>/images if it is url
+func (q *qemuProvider) image(node *nodeType) (path string, err error) {
+	image := node.Provider.Image
+	if !strings.HasPrefix(image, "http://") && !strings.HasPrefix(image, "https://") {
+		return filepath.Abs(image)
+	}
+
+	imagesDir := filepath.Join(q.project.stateDir, "images")
+	if err = os.MkdirAll(imagesDir, 0755); err != nil {
+		return
+	}
+	path, err = filepath.Abs(filepath.Join(imagesDir, filepath.Base(image)))
+	if err != nil {
+		return
+	}
+	if _, statErr := os.Stat(path); statErr == nil {
+		return
+	}
+
+	fmt.Fprintln(node.outWriter(), "Downloading", image)
+	resp, err := http.Get(image)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Cannot download %s: %s", image, resp.Status)
+	}
+
+	f, err := ioutil.TempFile(imagesDir, "download")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	err = os.Rename(f.Name(), path)
+	return
+}
+
+// returns random free tcp port on localhost
+func freePort() (port int, err error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// returns [tag, host dir, guest dir] of folders shared with 9p,
+// node directory is mounted as /clover like on other providers
+func (q *qemuProvider) syncedFolders(node *nodeType) (folders [][]string, err error) {
+	for i, folder := range append([]string{q.project.nodeDir(node) + ":/clover"}, node.Provider.SyncedFolders...) {
+		dirs, err := resolveDir(folder)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, []string{fmt.Sprintf("clover%d", i), dirs[0], dirs[1]})
+	}
+	return
+}
+
+// writes NoCloud seed iso with user-data and meta-data
+func (q *qemuProvider) seed(node *nodeType) (err error) {
+	mounts, err := q.syncedFolders(node)
+	if err != nil {
+		return
+	}
+
+	publicKey, err := ioutil.ReadFile(q.path(node, "id_ed25519.pub"))
+	if err != nil {
+		return
+	}
+
+	seedDir := q.path(node, "seed")
+	if err = os.MkdirAll(seedDir, 0755); err != nil {
+		return
+	}
+	data := struct {
+		Name      string
+		User      string
+		PublicKey string
+		Mounts    [][]string
+	}{node.Name, qemuUser, strings.TrimSpace(string(publicKey)), mounts}
+
+	for name, tpl := range map[string]string{"user-data": cloudInitUserData, "meta-data": cloudInitMetaData} {
+		content, err := renderTemplate(tpl, data)
+		if err != nil {
+			return err
+		}
+		if err = writeFile(filepath.Join(seedDir, name), content); err != nil {
+			return err
+		}
+	}
+
+	// cloud-localds is the simplest, any of mkisofs flavours works too
+	iso := q.path(node, "seed.iso")
+	var cmd *exec.Cmd
+	if execInstalled("cloud-localds", "") == nil {
+		cmd = exec.Command("cloud-localds", iso, "user-data", "meta-data")
+	} else if execInstalled("xorriso", "") == nil {
+		cmd = exec.Command("xorriso", "-as", "mkisofs", "-output", iso, "-volid", "cidata", "-joliet", "-rock", "user-data", "meta-data")
+	} else if execInstalled("genisoimage", "") == nil {
+		cmd = exec.Command("genisoimage", "-output", iso, "-volid", "cidata", "-joliet", "-rock", "user-data", "meta-data")
+	} else if execInstalled("mkisofs", "") == nil {
+		cmd = exec.Command("mkisofs", "-output", iso, "-volid", "cidata", "-joliet", "-rock", "user-data", "meta-data")
+	} else {
+		return fmt.Errorf("one of cloud-localds, xorriso, genisoimage or mkisofs is required to build cloud-init seed")
+	}
+	cmd.Dir = seedDir
+	cmd.Stderr = node.errWriter()
+	return cmd.Run()
+}
+
+// prepares overlay disk, ssh key, seed and ssh port for new node
+func (q *qemuProvider) prepare(node *nodeType) (err error) {
+	image, err := q.image(node)
+	if err != nil {
+		return
+	}
+
+	// leftovers of failed creation
+	for _, name := range []string{"id_ed25519", "id_ed25519.pub"} {
+		os.Remove(q.path(node, name))
+	}
+
+	steps := [][]string{
+		{"qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-b", image, q.path(node, "disk.qcow2")},
+		{"ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "clover-" + node.Name, "-f", q.path(node, "id_ed25519")},
+	}
+	for _, step := range steps {
+		cmd := exec.Command(step[0], step[1:]...)
+		cmd.Stderr = node.errWriter()
+		if err = cmd.Run(); err != nil {
+			return
+		}
+	}
+
+	if err = q.seed(node); err != nil {
+		return
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return
+	}
+	return writeFile(q.path(node, "ssh_port"), strconv.Itoa(port))
+}
+
+// returns true if kvm can be used, qemu falls back to tcg otherwise
+func kvmAvailable() bool {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// builds qemu arguments, synced folders are shared with 9p and mounted by cloud-init
+func (q *qemuProvider) args(node *nodeType) (args []string, err error) {
+	address, err := q.Address(node)
+	if err != nil {
+		return
+	}
+
+	accel, cpu := "tcg", "max"
+	if kvmAvailable() {
+		accel, cpu = "kvm", "host"
+	}
+
+	netdev := fmt.Sprintf("user,id=net0,hostfwd=tcp:127.0.0.1:%d-:22", address.Port)
+	for _, port := range node.Provider.Network.ForwardedPort {
+		list := strings.Split(port, ":")
+		switch len(list) {
+		case 3:
+			netdev += fmt.Sprintf(",hostfwd=%s:127.0.0.1:%s-:%s", list[2], list[0], list[1])
+		case 5:
+			netdev += fmt.Sprintf(",hostfwd=%s:%s:%s-%s:%s", list[4], list[0], list[1], list[2], list[3])
+		default:
+			return nil, fmt.Errorf("Cannot parse forwarded port %s", port)
+		}
+	}
+
+	memory, cpus := 1024, 1
+	if node.Provider.Memory > 0 {
+		memory = node.Provider.Memory
+	}
+	if node.Provider.Cpus > 0 {
+		cpus = node.Provider.Cpus
+	}
+
+	args = []string{
+		"-name", "clover-" + node.Name,
+		"-machine", "q35,accel=" + accel,
+		"-cpu", cpu,
+		"-m", strconv.Itoa(memory),
+		"-smp", strconv.Itoa(cpus),
+		"-drive", fmt.Sprintf("file=%s,if=virtio,format=qcow2", q.path(node, "disk.qcow2")),
+		"-drive", fmt.Sprintf("file=%s,if=virtio,format=raw,readonly=on", q.path(node, "seed.iso")),
+		"-netdev", netdev,
+		"-device", "virtio-net-pci,netdev=net0",
+		"-display", "none",
+		"-serial", "file:" + q.path(node, "console.log"),
+		"-monitor", fmt.Sprintf("unix:%s,server,nowait", q.path(node, "monitor.sock")),
+		"-pidfile", q.path(node, "qemu.pid"),
+		"-daemonize",
+	}
+
+	folders, err := q.syncedFolders(node)
+	if err != nil {
+		return
+	}
+	for _, folder := range folders {
+		args = append(args, "-virtfs", fmt.Sprintf("local,path=%s,mount_tag=%s,security_model=none", folder[1], folder[0]))
+	}
+	return
+}
+
+// boots the node from overlay disk, creates overlay and seed first if node was not created
+func (q *qemuProvider) Create(node *nodeType) (err error) {
+	if err = os.MkdirAll(q.project.nodeDir(node), 0755); err != nil {
+		return
+	}
+
+	status, err := q.Status(node)
+	if err != nil || status == vagrantutil.Running {
+		return
+	}
+
+	if status == vagrantutil.NotCreated {
+		if err = q.prepare(node); err != nil {
+			return
+		}
+	}
+
+	args, err := q.args(node)
+	if err != nil {
+		return
+	}
+	if !kvmAvailable() {
+		fmt.Fprintln(node.outWriter(), "KVM is not available, falling back to TCG emulation, boot may take several minutes")
+	}
+	fmt.Fprintln(node.outWriter(), qemuBinary, strings.Join(args, " "))
+	cmd := exec.Command(qemuBinary, args...)
+	cmd.Stdout = node.outWriter()
+	cmd.Stderr = node.errWriter()
+	if err = cmd.Run(); err != nil {
+		return
+	}
+
+	return q.waitForSSH(node, 10*time.Minute)
+}
+
+// waits for cloud-init to create user and start sshd, timeout is used unless node.ssh.timeout is set,
+// waiting ends early if qemu exits
+func (q *qemuProvider) waitForSSH(node *nodeType, timeout time.Duration) (err error) {
+	retry := newSSHRetry(node.SSH)
+	if node.SSH.Timeout == 0 {
+		retry.timeout = timeout
+	}
+	client, _, err := retry.dial(func() (sshItems, error) {
+		if q.pid(node) == 0 {
+			return sshItems{}, &sshAbortError{fmt.Errorf("qemu exited, see %s", q.path(node, "console.log"))}
+		}
+		return q.Address(node)
+	}, q.project.knownHosts(node), node.errWriter())
+	if err != nil {
+		return fmt.Errorf("node %s: %s", node.Name, err)
+	}
+	return client.Close()
+}
+
+// sends ACPI power button event through monitor, kills qemu if guest does not stop in time
+func (q *qemuProvider) Halt(node *nodeType) (err error) {
+	pid := q.pid(node)
+	if pid == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", q.path(node, "monitor.sock")); err == nil {
+		fmt.Fprintln(conn, "system_powerdown")
+		conn.Close()
+	}
+	for i := 0; i < 60; i++ {
+		if q.pid(node) == 0 {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	return q.kill(pid)
+}
+
+func (q *qemuProvider) kill(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Kill()
+}
+
+// stops qemu, node directory with overlay is removed afterwards
+func (q *qemuProvider) Destroy(node *nodeType) (err error) {
+	if pid := q.pid(node); pid != 0 {
+		return q.kill(pid)
+	}
+	return
+}
+
+func (q *qemuProvider) Connect(node *nodeType) (Transport, error) {
+	return newSSHTransport(q.project, node, func() (sshItems, error) { return q.Address(node) }), nil
+}
+
+// guest ssh is forwarded to localhost port stored in ssh_port
+func (q *qemuProvider) Address(node *nodeType) (address sshItems, err error) {
+	address = sshItems{Host: "127.0.0.1", User: qemuUser, IdentityFile: q.path(node, "id_ed25519")}
+	data, err := ioutil.ReadFile(q.path(node, "ssh_port"))
+	if err != nil {
+		return
+	}
+	address.Port, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	return
+}
+
+func (q *qemuProvider) Login(node *nodeType) (err error) {
+	address, err := q.Address(node)
+	if err != nil {
+		return
+	}
+	return sshLogin(address, q.project.knownHosts(node))
+}
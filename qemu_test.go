@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+func TestQemuPid(t *testing.T) {
+	p := &project{stateDir: t.TempDir()}
+	q := &qemuProvider{project: p}
+	node := &nodeType{Name: "vm"}
+	if err := os.MkdirAll(p.nodeDir(node), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		pid  string
+	}{
+		{"missing process", "999999999"},
+		// running process which is not qemu of the node, e.g. pid reused after host reboot
+		{"reused pid", strconv.Itoa(os.Getpid())},
+		{"garbage", "qemu"},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(q.path(node, "qemu.pid"), []byte(test.pid+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if pid := q.pid(node); pid != 0 {
+			t.Errorf("%s: pid %d, expected 0", test.name, pid)
+		}
+	}
+
+	// process with monitor socket of the node on command line is its qemu
+	cmd := exec.Command("sh", "-c", "sleep 30", q.path(node, "monitor.sock"))
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	if err := ioutil.WriteFile(q.path(node, "qemu.pid"), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pid := q.pid(node); pid != cmd.Process.Pid {
+		t.Errorf("qemu of the node: pid %d, expected %d", pid, cmd.Process.Pid)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// jsonSchema is a subset of json schema draft 7 used to describe configuration file
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+}
+
+// returns schema of go type, structs are described by their yaml, desc, schema (required or partial) and enum tags
+func typeSchema(t reflect.Type) *jsonSchema {
+	switch t.Kind() {
+	case reflect.Struct:
+		closed := false
+		schema := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}, AdditionalProperties: &closed}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if key == "" || key == "-" {
+				continue
+			}
+			property := typeSchema(field.Type)
+			property.Description = field.Tag.Get("desc")
+			if enum := field.Tag.Get("enum"); enum != "" {
+				property.Enum = strings.Split(enum, ",")
+			}
+			switch field.Tag.Get("schema") {
+			case "required":
+				schema.Required = append(schema.Required, key)
+			case "partial":
+				// e.g. defaults, any key of the type or its nested types may be omitted
+				optional(property)
+			}
+			schema.Properties[key] = property
+		}
+		return schema
+	case reflect.Slice:
+		return &jsonSchema{Type: "array", Items: typeSchema(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	}
+	return &jsonSchema{}
+}
+
+// clears required properties of the schema and all schemas nested in it
+func optional(schema *jsonSchema) {
+	schema.Required = nil
+	for _, property := range schema.Properties {
+		optional(property)
+	}
+	if schema.Items != nil {
+		optional(schema.Items)
+	}
+}
+
+// returns paths of properties without description
+func undocumented(schema *jsonSchema, path string) (paths []string) {
+	for key, property := range schema.Properties {
+		if property.Description == "" {
+			paths = append(paths, joinPath(path, key))
+		}
+		paths = append(paths, undocumented(property, joinPath(path, key))...)
+	}
+	if schema.Items != nil {
+		paths = append(paths, undocumented(schema.Items, path+"[]")...)
+	}
+	return
+}
+
+// returns json schema of configuration file, every key must have desc tag, see schema_test.go
+func configSchema() (schema []byte, err error) {
+	root := typeSchema(reflect.TypeOf(configType{}))
+	root.Schema = "http://json-schema.org/draft-07/schema#"
+	root.Title = "clover configuration file"
+	return json.MarshalIndent(root, "", "  ")
+}
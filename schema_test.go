@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestConfigSchemaDocumented(t *testing.T) {
+	paths := undocumented(typeSchema(reflect.TypeOf(configType{})), "")
+	sort.Strings(paths)
+	for _, path := range paths {
+		t.Errorf("configuration key %s has no desc tag", path)
+	}
+}
+
+func TestConfigSchemaRequired(t *testing.T) {
+	root := typeSchema(reflect.TypeOf(configType{}))
+	tests := []struct {
+		path     []string
+		required []string
+	}{
+		{[]string{"nodes", "[]"}, []string{"name"}},
+		{[]string{"nodes", "[]", "provider"}, nil},
+		{[]string{"nodes", "[]", "provisioner", "[]"}, []string{"name"}},
+		{[]string{"nodes", "[]", "provider", "disks", "[]"}, []string{"name", "size"}},
+		// defaults are partial, nested types are too
+		{[]string{"defaults"}, nil},
+		{[]string{"defaults", "provisioner", "[]"}, nil},
+		{[]string{"defaults", "files", "[]"}, nil},
+		{[]string{"defaults", "provider", "disks", "[]"}, nil},
+	}
+	for _, test := range tests {
+		schema := root
+		for _, key := range test.path {
+			if key == "[]" {
+				schema = schema.Items
+			} else {
+				schema = schema.Properties[key]
+			}
+			if schema == nil {
+				t.Fatalf("%v: no schema for %s", test.path, key)
+			}
+		}
+		if !reflect.DeepEqual(schema.Required, test.required) {
+			t.Errorf("%v: required %v, expected %v", test.path, schema.Required, test.required)
+		}
+	}
+}
+
+func TestConfigSchemaJSON(t *testing.T) {
+	data, err := configSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]interface{}
+	if err = json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema["$schema"] != "http://json-schema.org/draft-07/schema#" {
+		t.Errorf("unexpected $schema %v", schema["$schema"])
+	}
+}
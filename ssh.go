@@ -1,17 +1,24 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
 )
 
 const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -24,100 +31,507 @@ func randFileName() string {
 	return string(b)
 }
 
-func getVagrantSSHDetails2(node *nodeType, vagrantDir string, vmName string) (err error) {
-	os.Chdir(vagrantDir)
-	defer os.Chdir("..")
-	out, err := exec.Command("vagrant", "ssh-config", vmName).Output()
+// passphrase of encrypted private keys, it is asked for on terminal if not set
+const passphraseEnv = "CLOVER_SSH_PASSPHRASE"
+
+// decrypted private keys by path, passphrase is asked for once
+var (
+	signersMu sync.Mutex
+	signers   = map[string]ssh.Signer{}
+)
+
+// returns signer of private key file, encrypted key is decrypted with passphrase from CLOVER_SSH_PASSPHRASE or terminal
+func privateKeySigner(path string) (signer ssh.Signer, err error) {
+	signersMu.Lock()
+	defer signersMu.Unlock()
+	if signer, ok := signers[path]; ok {
+		return signer, nil
+	}
+
+	key, err := ioutil.ReadFile(path)
 	if err != nil {
 		return
 	}
-	outSplitted := strings.Split(string(out), "\n")
-
-	for _, item := range outSplitted {
-		item = strings.TrimSpace(item)
-		if strings.HasPrefix(item, "HostName ") {
-			node.SSH.Host = strings.Split(item, " ")[1]
-		} else if strings.HasPrefix(item, "User ") {
-			node.SSH.User = strings.Split(item, " ")[1]
-		} else if strings.HasPrefix(item, "Port ") {
-			node.SSH.Port, err = strconv.Atoi(strings.Split(item, " ")[1])
+	signer, err = ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		passphrase := []byte(os.Getenv(passphraseEnv))
+		if len(passphrase) == 0 {
+			if !term.IsTerminal(int(os.Stdin.Fd())) {
+				return nil, fmt.Errorf("private key %s is encrypted, set %s or run clover in terminal", path, passphraseEnv)
+			}
+			fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", path)
+			passphrase, err = term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprintln(os.Stderr)
 			if err != nil {
 				return
 			}
-		} else if strings.HasPrefix(item, "IdentityFile ") {
-			node.SSH.IdentityFile = strings.Split(item, " ")[1]
 		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("private key %s: %s", path, err)
+	}
+	signers[path] = signer
+	return
+}
+
+// ssh agent of SSH_AUTH_SOCK, connected to once
+var sshAgent struct {
+	once   sync.Once
+	client agent.ExtendedAgent
+}
+
+// returns auth method of keys in ssh agent, nil if agent is not running
+func agentAuth() ssh.AuthMethod {
+	sshAgent.once.Do(func() {
+		if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+			if conn, err := net.Dial("unix", socket); err == nil {
+				sshAgent.client = agent.NewClient(conn)
+			}
+		}
+	})
+	if sshAgent.client == nil {
+		return nil
+	}
+	return ssh.PublicKeysCallback(sshAgent.client.Signers)
+}
+
+// returns client configuration of the address, authentication methods are tried in order: private key
+// of identity file, ssh agent keys, password; host key is verified against known hosts of the project
+func sshClientConfig(address sshItems, connectTimeout time.Duration, hostKeys *knownHosts) (config *ssh.ClientConfig, err error) {
+	var auth []ssh.AuthMethod
+	var keyErr error
+	if address.IdentityFile != "" {
+		var signer ssh.Signer
+		if signer, keyErr = privateKeySigner(address.IdentityFile); keyErr == nil {
+			auth = append(auth, ssh.PublicKeys(signer))
+		}
+	}
+	if method := agentAuth(); method != nil {
+		auth = append(auth, method)
+	}
+	if address.Password != "" {
+		auth = append(auth, ssh.Password(address.Password), ssh.KeyboardInteractive(
+			func(user, instruction string, questions []string, echos []bool) (answers []string, err error) {
+				for range questions {
+					answers = append(answers, address.Password)
+				}
+				return
+			}))
+	}
+	// default key may be missing if agent or password is used
+	if keyErr != nil && (!os.IsNotExist(keyErr) || len(auth) == 0) {
+		return nil, keyErr
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no ssh authentication method for %s@%s, set identity file, password or run ssh agent", address.User, address.Host)
+	}
+
+	config = &ssh.ClientConfig{
+		User:              address.User,
+		Auth:              auth,
+		HostKeyCallback:   hostKeys.check,
+		HostKeyAlgorithms: hostKeys.algorithms(),
+		Timeout:           connectTimeout,
 	}
 	return
 }
 
-func sshConnection(node *nodeType, vagrantDir string) (client *ssh.Client, err error) {
-	getVagrantSSHDetails2(node, vagrantDir, node.Name)
+// jumpHost is one hop of proxy jump chain
+type jumpHost struct {
+	user, host string
+	port       int
+}
 
-	key, err := ioutil.ReadFile(node.SSH.IdentityFile)
+// returns address of the jump host in <user>@<host>:<port> form
+func (j jumpHost) String() string {
+	return j.user + "@" + net.JoinHostPort(j.host, strconv.Itoa(j.port))
+}
+
+// returns hops of comma separated [<user>@]<host>[:<port>] proxy jump chain in order they are
+// connected through, user of each hop defaults to user of the node
+func parseProxyJump(proxyJump string, user string) (hops []jumpHost, err error) {
+	for _, spec := range strings.Split(proxyJump, ",") {
+		hop := jumpHost{user: user, host: strings.TrimSpace(spec), port: 22}
+		if i := strings.LastIndex(hop.host, "@"); i >= 0 {
+			hop.user, hop.host = hop.host[:i], hop.host[i+1:]
+		}
+		if h, p, splitErr := net.SplitHostPort(hop.host); splitErr == nil {
+			hop.host = h
+			if hop.port, err = strconv.Atoi(p); err != nil || hop.port < 1 || hop.port > 65535 {
+				return nil, fmt.Errorf("invalid port of proxy jump %s", spec)
+			}
+		}
+		// colon is only in ipv6 address, e.g. [fd00::1]:2222
+		if hop.user == "" || hop.host == "" || strings.ContainsAny(hop.host, "@/ ") || (strings.Contains(hop.host, ":") && net.ParseIP(hop.host) == nil) {
+			return nil, fmt.Errorf("proxy jump %s must be [<user>@]<host>[:<port>]", spec)
+		}
+		hops = append(hops, hop)
+	}
+	return
+}
+
+// connects to the address, through proxy jump hosts if they are set, every jump host is reached
+// through the previous one and authenticated the same way as the node, their connections are
+// closed with the node connection
+func sshDial(address sshItems, config *ssh.ClientConfig, hostKeys *knownHosts) (client *ssh.Client, err error) {
+	target := net.JoinHostPort(address.Host, strconv.Itoa(address.Port))
+	if address.ProxyJump == "" {
+		return ssh.Dial("tcp", target, config)
+	}
+
+	hops, err := parseProxyJump(address.ProxyJump, address.User)
 	if err != nil {
 		return
 	}
+	var bastion *ssh.Client
+	for _, hop := range hops {
+		jump := address
+		jump.ProxyJump = ""
+		jump.User, jump.Host, jump.Port = hop.user, hop.host, hop.port
+		jumpTarget := net.JoinHostPort(hop.host, strconv.Itoa(hop.port))
+		jumpConfig, err := sshClientConfig(jump, config.Timeout, hostKeys.bastion(jumpTarget))
+		if err != nil {
+			if bastion != nil {
+				bastion.Close()
+			}
+			return nil, err
+		}
+		if bastion, err = sshDialThrough(bastion, jumpTarget, jumpConfig); err != nil {
+			return nil, fmt.Errorf("proxy jump %s: %w", jumpTarget, err)
+		}
+	}
+	return sshDialThrough(bastion, target, config)
+}
 
-	signer, err := ssh.ParsePrivateKey(key)
+// connects to the address through the bastion, it is closed when the connection fails or ends
+func sshDialThrough(bastion *ssh.Client, address string, config *ssh.ClientConfig) (client *ssh.Client, err error) {
+	if bastion == nil {
+		return ssh.Dial("tcp", address, config)
+	}
+	conn, err := bastion.Dial("tcp", address)
+	if err != nil {
+		bastion.Close()
+		return
+	}
+	c, channels, requests, err := ssh.NewClientConn(conn, address, config)
 	if err != nil {
+		bastion.Close()
 		return
 	}
+	client = ssh.NewClient(c, channels, requests)
+	go func() {
+		client.Wait()
+		bastion.Close()
+	}()
+	return
+}
+
+func sshConnection(address sshItems, connectTimeout time.Duration, hostKeys *knownHosts) (client *ssh.Client, err error) {
+	config, err := sshClientConfig(address, connectTimeout, hostKeys)
+	if err != nil {
+		return
+	}
+	return sshDial(address, config, hostKeys)
+}
+
+// defaults of node.ssh timeouts, wait between connection attempts doubles up to sshMaxBackoff
+const (
+	sshTimeout        = 300 * time.Second
+	sshConnectTimeout = 10 * time.Second
+	sshMaxBackoff     = 30 * time.Second
+)
+
+// sshRetry is how long and how many times node is connected to before it is considered unreachable
+type sshRetry struct {
+	timeout        time.Duration
+	connectTimeout time.Duration
+	// 0 is unlimited within timeout
+	retries int
+}
+
+// returns retry settings of node.ssh with defaults
+func newSSHRetry(settings sshType) sshRetry {
+	retry := sshRetry{timeout: sshTimeout, connectTimeout: sshConnectTimeout, retries: settings.Retries}
+	if settings.Timeout > 0 {
+		retry.timeout = time.Duration(settings.Timeout) * time.Second
+	}
+	if settings.ConnectTimeout > 0 {
+		retry.connectTimeout = time.Duration(settings.ConnectTimeout) * time.Second
+	}
+	return retry
+}
+
+// sshAbortError is returned by address function of sshRetry.dial when waiting makes no sense, e.g. node process exited
+type sshAbortError struct {
+	err error
+}
+
+func (e *sshAbortError) Error() string {
+	return e.err.Error()
+}
+
+// connects to the node until sshd is ready, address is resolved for every attempt as it may change
+// while the node boots, e.g. vagrant forwarded port; unreadable private key, changed host key and sshAbortError are not retried
+func (r sshRetry) dial(address func() (sshItems, error), hostKeys *knownHosts, stderr io.Writer) (client *ssh.Client, resolved sshItems, err error) {
+	deadline := time.Now().Add(r.timeout)
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		if resolved, err = address(); err == nil {
+			var config *ssh.ClientConfig
+			if config, err = sshClientConfig(resolved, r.connectTimeout, hostKeys); err != nil {
+				return
+			}
+			if client, err = sshDial(resolved, config, hostKeys); err == nil {
+				return
+			}
+			var keyErr *hostKeyError
+			if errors.As(err, &keyErr) {
+				return
+			}
+		}
+
+		var abort *sshAbortError
+		if errors.As(err, &abort) {
+			return nil, resolved, abort.err
+		}
+
+		if (r.retries > 0 && attempt >= r.retries) || time.Now().Add(wait).After(deadline) {
+			return nil, resolved, fmt.Errorf("ssh is not available after %d attempts: %s", attempt, err)
+		}
+		fmt.Fprintf(stderr, "Waiting for ssh, attempt %d failed: %s\n", attempt, err)
+		time.Sleep(wait)
+		if wait *= 2; wait > sshMaxBackoff {
+			wait = sshMaxBackoff
+		}
+	}
+}
+
+// interval of keepalive requests, idle connections are not dropped by sshd or NAT and dead ones are noticed
+const sshKeepAlive = 30 * time.Second
+
+// sshTransport runs commands over single ssh connection to the node, address is resolved by provider once
+// and again only if the node cannot be reached with it, e.g. vagrant forwarded port changed after reload
+type sshTransport struct {
+	address  func() (sshItems, error)
+	hostKeys *knownHosts
+	retry    sshRetry
+	// idle connection is kept alive, see project.longLived
+	longLived bool
+
+	mu       sync.Mutex
+	resolved *sshItems
+	client   *ssh.Client
+	sftp     *sftp.Client
+	// closed when client is dropped, stops its keepalive
+	done chan struct{}
+}
+
+func newSSHTransport(p *project, node *nodeType, address func() (sshItems, error)) *sshTransport {
+	return &sshTransport{address: address, hostKeys: p.knownHosts(node), retry: newSSHRetry(node.SSH), longLived: p.longLived}
+}
+
+// returns live connection, connection broken e.g. by reboot is dropped and dialed again, waiting
+// for ssh is reported to stderr
+func (t *sshTransport) connect(stderr io.Writer) (client *ssh.Client, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client != nil {
+		if err = keepAlive(t.client); err == nil {
+			return t.client, nil
+		}
+		t.drop()
+	}
+
+	if t.resolved != nil {
+		if client, err = sshConnection(*t.resolved, t.retry.connectTimeout, t.hostKeys); err != nil {
+			t.resolved = nil
+		}
+	}
+	if t.resolved == nil {
+		var address sshItems
+		if client, address, err = t.retry.dial(t.address, t.hostKeys, stderr); err != nil {
+			return
+		}
+		t.resolved = &address
+	}
 
-	config := &ssh.ClientConfig{
-		User: node.SSH.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	t.client, t.done = client, make(chan struct{})
+	if t.longLived {
+		go t.keepAliveLoop(client, t.done)
 	}
+	return client, nil
+}
+
+// sends keepalive request, rebooting node may not answer at all
+func keepAlive(client *ssh.Client) error {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	select {
+	case err := <-reply:
+		return err
+	case <-time.After(sshKeepAlive / 3):
+		return fmt.Errorf("no reply to keepalive in %s", sshKeepAlive/3)
+	}
+}
 
-	client, err = ssh.Dial("tcp", fmt.Sprintf("%s:%s", node.SSH.Host, strconv.Itoa(node.SSH.Port)), config)
+// sends keepalive requests until connection is dropped, dead connection is dropped
+func (t *sshTransport) keepAliveLoop(client *ssh.Client, done chan struct{}) {
+	ticker := time.NewTicker(sshKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := keepAlive(client); err != nil {
+				t.mu.Lock()
+				if t.client == client {
+					t.drop()
+				}
+				t.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// closes current connection and its sftp client, t.mu must be held
+func (t *sshTransport) drop() {
+	if t.client == nil {
+		return
+	}
+	close(t.done)
+	if t.sftp != nil {
+		t.sftp.Close()
+	}
+	t.client.Close()
+	t.client, t.sftp, t.done = nil, nil, nil
+}
+
+// returns sftp client of current connection, it is opened on first upload
+func (t *sshTransport) sftpConn(stderr io.Writer) (sftpClient *sftp.Client, err error) {
+	client, err := t.connect(stderr)
 	if err != nil {
 		return
 	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sftp != nil && t.client == client {
+		return t.sftp, nil
+	}
+	if sftpClient, err = sftp.NewClient(client); err != nil {
+		return
+	}
+	if t.client == client {
+		t.sftp = sftpClient
+	}
 	return
 }
 
-func (node *nodeType) sftpConn(vagrantDir string) (sftpClient *sftp.Client, err error) {
-	client, err := sshConnection(node, vagrantDir)
+// runs command with sudo, output is streamed while it runs, e.g. long provisioners show progress
+func (t *sshTransport) Run(cmd string, stdout, stderr io.Writer) (err error) {
+	session, err := t.session(stderr)
 	if err != nil {
 		return
 	}
-	sftpClient, err = sftp.NewClient(client)
+	defer session.Close()
+
+	// session copies stdout and stderr and waits for the copies before Run returns
+	session.Stdout, session.Stderr = stdout, stderr
+	return session.Run("sudo sh -c " + shellQuote(cmd))
+}
+
+// runs command with sudo, returns its stdout
+func (t *sshTransport) Output(cmd string, stderr io.Writer) (out []byte, err error) {
+	session, err := t.session(stderr)
 	if err != nil {
-		sftpClient.Close()
-		client.Close()
 		return
 	}
-	return
+	defer session.Close()
+
+	session.Stderr = stderr
+	return session.Output("sudo sh -c " + shellQuote(cmd))
 }
 
-func (node *nodeType) sshCommand(vagrantDir string, cmd string, output bool) (err error) {
-	client, err := sshConnection(node, vagrantDir)
+// opens session on live connection
+func (t *sshTransport) session(stderr io.Writer) (session *ssh.Session, err error) {
+	client, err := t.connect(stderr)
 	if err != nil {
 		return
 	}
-	defer client.Close()
+	return client.NewSession()
+}
 
-	session, err := client.NewSession()
+// uploads file into temporary location and moves it into destination with sudo
+func (t *sshTransport) Upload(path string, content []byte, stderr io.Writer) (err error) {
+	sftpClient, err := t.sftpConn(stderr)
 	if err != nil {
 		return
 	}
-	defer session.Close()
 
-	stderr, _ := session.StderrPipe()
-	stdout, _ := session.StdoutPipe()
+	// create tmp dir
+	if _, err = sftpClient.Lstat(".clover"); os.IsNotExist(err) {
+		if err = sftpClient.Mkdir(".clover"); err != nil {
+			return
+		}
+	}
 
-	go io.Copy(os.Stderr, stderr)
-	go io.Copy(os.Stdout, stdout)
-	out, err := session.Output(cmd)
+	tmpFileName := sftpClient.Join(".clover", randFileName())
+	f, err := sftpClient.Create(tmpFileName)
 	if err != nil {
 		return
 	}
+	if _, err = f.Write(content); err != nil {
+		f.Close()
+		return
+	}
+	f.Close()
+
+	// create dir if not exists and move temporary file into destination
+	return t.Run(fmt.Sprintf("mkdir -p %s && mv %s %s", shellQuote(filepath.Dir(path)), shellQuote(tmpFileName), shellQuote(path)), nil, stderr)
+}
 
-	if output {
-		fmt.Println(string(out))
+// closes connection, transport may still be used, it connects again
+func (t *sshTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.drop()
+	return nil
+}
+
+// returns ssh client options of the address used by clover ssh and ansible inventory, host key is verified
+// against known hosts of the project
+func sshClientOptions(address sshItems, hostKeys *knownHosts) []string {
+	options := hostKeys.sshOptions()
+	if address.ProxyJump != "" {
+		if hops, err := parseProxyJump(address.ProxyJump, address.User); err == nil {
+			jumps := make([]string, len(hops))
+			for i, hop := range hops {
+				jumps[i] = hop.String()
+			}
+			options = append(options, "-o", "ProxyJump="+strings.Join(jumps, ","))
+		}
 	}
-	return
+	return options
+}
+
+// runs interactive ssh client against the address, ssh asks for password and passphrase itself
+func sshLogin(address sshItems, hostKeys *knownHosts) error {
+	args := sshClientOptions(address, hostKeys)
+	if _, err := os.Stat(address.IdentityFile); err == nil {
+		args = append(args, "-i", address.IdentityFile)
+	}
+	args = append(args, "-p", strconv.Itoa(address.Port), fmt.Sprintf("%s@%s", address.User, address.Host))
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseProxyJump(t *testing.T) {
+	tests := []struct {
+		proxyJump string
+		hops      []jumpHost
+		err       string
+	}{
+		{"bastion", []jumpHost{{"deploy", "bastion", 22}}, ""},
+		{"jump@bastion:2222", []jumpHost{{"jump", "bastion", 2222}}, ""},
+		{"jump@[fd00::1]:2222", []jumpHost{{"jump", "fd00::1", 2222}}, ""},
+		{"jump@bastion:2222,lab-gw", []jumpHost{{"jump", "bastion", 2222}, {"deploy", "lab-gw", 22}}, ""},
+		{"jump@bastion:2222, admin@lab-gw:22022", []jumpHost{{"jump", "bastion", 2222}, {"admin", "lab-gw", 22022}}, ""},
+		{"user@bastion:port", nil, "invalid port of proxy jump user@bastion:port"},
+		{"bastion,lab-gw:0", nil, "invalid port of proxy jump lab-gw:0"},
+		{"bastion,", nil, "proxy jump  must be [<user>@]<host>[:<port>]"},
+		{"@bastion", nil, "proxy jump @bastion must be [<user>@]<host>[:<port>]"},
+	}
+
+	for _, test := range tests {
+		hops, err := parseProxyJump(test.proxyJump, "deploy")
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: error %v, expected %s", test.proxyJump, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.proxyJump, err)
+		} else if !reflect.DeepEqual(hops, test.hops) {
+			t.Errorf("%s: hops %v, expected %v", test.proxyJump, hops, test.hops)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// lifecycle stages of the node, recorded in state file
+const (
+	stageCreated   = "created"
+	stageConverged = "converged"
+	stageVerified  = "verified"
+)
+
+// nodeState is what clover knows about the node without asking its provider
+type nodeState struct {
+	Provider string `json:"provider"`
+	// container, instance or machine name used by the provider
+	ID    string `json:"id"`
+	Stage string `json:"stage"`
+	// time every stage was reached at
+	Timestamps map[string]time.Time `json:"timestamps"`
+	// last converge or verify run
+	LastCommand string    `json:"last_command"`
+	LastRun     time.Time `json:"last_run"`
+	ExitStatus  int       `json:"exit_status"`
+	LastError   string    `json:"last_error,omitempty"`
+	// hashes of node and provider configuration the node was created and converged with
+	Hashes map[string]string `json:"hashes"`
+	// hashes of provisioners at their last successful run, see provisionerKey
+	Provisioners map[string]string `json:"provisioners,omitempty"`
+}
+
+// projectState is stored in <stateDir>/state.json
+type projectState struct {
+	Nodes map[string]*nodeState `json:"nodes"`
+	// hashes of top level provisioners at their last successful run
+	Provisioners map[string]string `json:"provisioners,omitempty"`
+}
+
+// identifier is implemented by providers which know better id of the node than instance name
+type identifier interface {
+	ID(node *nodeType) string
+}
+
+// returns sha256 of yaml representation of configuration section
+func configHash(section interface{}) string {
+	data, err := yaml.Marshal(section)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// returns hashes of node configuration, provider hash changes require node to be recreated
+func nodeHashes(node *nodeType) map[string]string {
+	return map[string]string{
+		"node":     configHash(node),
+		"provider": configHash(node.Provider),
+	}
+}
+
+// returns exit code of the failed command, 1 for other errors
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+// removes state directory after all nodes were destroyed, known_hosts is kept with host keys of
+// static nodes and jump hosts, they are not recreated
+func (p *project) removeStateDir() (err error) {
+	files, err := ioutil.ReadDir(p.stateDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	kept := false
+	for _, file := range files {
+		if file.Name() == "known_hosts" {
+			kept = true
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(p.stateDir, file.Name())); err != nil {
+			return
+		}
+	}
+	if !kept {
+		return os.Remove(p.stateDir)
+	}
+	return
+}
+
+func (p *project) statePath() string {
+	return filepath.Join(p.stateDir, "state.json")
+}
+
+// reads state file, missing file is empty state
+func (p *project) loadState() (state projectState, err error) {
+	data, err := ioutil.ReadFile(p.statePath())
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err == nil {
+		if err = json.Unmarshal(data, &state); err != nil {
+			err = fmt.Errorf("Failed to parse %s: %s", p.statePath(), err)
+		}
+	}
+	if state.Nodes == nil {
+		state.Nodes = map[string]*nodeState{}
+	}
+	return
+}
+
+// returns state of the node, nil if it was never created
+func (p *project) nodeState(node *nodeType) (state *nodeState, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	projectState, err := p.loadState()
+	return projectState.Nodes[node.Name], err
+}
+
+// applies fn to state of the node and writes state file, node state is removed if fn returns nil
+func (p *project) updateState(node *nodeType, fn func(state *nodeState) *nodeState) error {
+	return p.saveState(func(projectState *projectState) bool {
+		state, exists := projectState.Nodes[node.Name]
+		if !exists {
+			state = &nodeState{Timestamps: map[string]time.Time{}, Hashes: map[string]string{}}
+		}
+		if state = fn(state); state != nil {
+			projectState.Nodes[node.Name] = state
+		} else if exists {
+			delete(projectState.Nodes, node.Name)
+		} else {
+			return false
+		}
+		return true
+	})
+}
+
+// applies fn to project state, state file is written if fn returns true
+func (p *project) saveState(fn func(state *projectState) bool) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	projectState, err := p.loadState()
+	if err != nil || !fn(&projectState) {
+		return
+	}
+
+	data, err := json.MarshalIndent(projectState, "", "  ")
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(p.stateDir, 0755); err != nil {
+		return
+	}
+	// other clover processes may read the state at the same time
+	if err = writeFile(p.statePath()+".tmp", string(data)); err != nil {
+		return
+	}
+	return os.Rename(p.statePath()+".tmp", p.statePath())
+}
+
+// records that the node reached the stage
+func (p *project) recordStage(node *nodeType, provider Provider, stage string) error {
+	return p.updateState(node, func(state *nodeState) *nodeState {
+		if stage != stageCreated && state.Stage == "" {
+			// node was not created by clover
+			return nil
+		}
+		state.Provider = node.Provider.Name
+		state.ID = p.instanceName(node)
+		if id, ok := provider.(identifier); ok {
+			state.ID = id.ID(node)
+		}
+		if stage == stageCreated {
+			if state.Stage != "" {
+				// node already exists, it was not recreated with current provider configuration
+				return state
+			}
+			state.Hashes["provider"] = nodeHashes(node)["provider"]
+		} else {
+			state.Hashes["node"] = nodeHashes(node)["node"]
+		}
+		state.Stage = stage
+		state.Timestamps[stage] = time.Now()
+		return state
+	})
+}
+
+// records result of converge or verify run
+func (p *project) recordRun(node *nodeType, command string, runErr error) error {
+	return p.updateState(node, func(state *nodeState) *nodeState {
+		if state.Stage == "" {
+			// node was never created, nothing to track
+			return nil
+		}
+		state.LastCommand = command
+		state.LastRun = time.Now()
+		state.ExitStatus = exitStatus(runErr)
+		state.LastError = ""
+		if runErr != nil {
+			state.LastError = runErr.Error()
+		}
+		return state
+	})
+}
+
+// returns key of the provisioner in state file, its id or hash of its definition, so keys do not
+// shift when provisioners are inserted or reordered, changed provisioner without id is a new one
+func provisionerKey(provisioner Provisioner) string {
+	if provisioner.ID != "" {
+		return "id-" + provisioner.ID
+	}
+	provisioner.RunOnce, provisioner.SkipUnchanged = false, false
+	return fmt.Sprintf("%s-%s", provisioner.Name, configHash(provisioner)[:16])
+}
+
+// returns hash of provisioner definition and local files it uses: directory tree of ansible
+// playbook and extra vars files, playbook of ansible-local is inside the node and is not hashed
+func (p *project) provisionerHash(provisioner Provisioner) (hash string, err error) {
+	h := sha256.New()
+	fmt.Fprintln(h, configHash(provisioner))
+
+	var files []string
+	if provisioner.Name == "ansible" && provisioner.Playbook != "" {
+		root := filepath.Dir(p.localPath(provisioner.Playbook))
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// clover state directories and vcs metadata are not part of the playbook
+			if info.IsDir() && path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if info.Mode().IsRegular() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		for _, extraVars := range provisioner.Extravars {
+			if strings.HasPrefix(extraVars, "@") {
+				files = append(files, p.localPath(strings.TrimPrefix(extraVars, "@")))
+			}
+		}
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		// path relative to configuration file, hash does not depend on current directory
+		name, relErr := filepath.Rel(p.configDir, file)
+		if relErr != nil {
+			name = file
+		}
+		fmt.Fprintf(h, "%s %x\n", name, sha256.Sum256(data))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// returns why the provisioner does not have to run, empty if it has to; previous are hashes of
+// provisioners at their last successful run
+func skipProvisioner(provisioner Provisioner, previous map[string]string, key, hash string) string {
+	last, ran := previous[key]
+	if provisioner.RunOnce && ran {
+		return "it runs once"
+	}
+	if provisioner.SkipUnchanged && last == hash {
+		return "nothing changed since its last run"
+	}
+	return ""
+}
+
+// records successful run of node provisioner
+func (p *project) recordProvisioner(node *nodeType, key, hash string) error {
+	return p.updateState(node, func(state *nodeState) *nodeState {
+		if state.Provisioners == nil {
+			state.Provisioners = map[string]string{}
+		}
+		state.Provisioners[key] = hash
+		return state
+	})
+}
+
+// returns what changed in configuration since the node was created or converged, empty if nothing
+func (state *nodeState) stale(node *nodeType) string {
+	hashes := nodeHashes(node)
+	if state.Hashes["provider"] != hashes["provider"] {
+		return "provider changed, destroy and converge"
+	}
+	if state.Stage != stageCreated && state.Hashes["node"] != hashes["node"] {
+		return "config changed, converge"
+	}
+	return ""
+}
+
+// prints provider status of the nodes along with their recorded state
+func printStatus(p *project, nodes []nodeType) (err error) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tPROVIDER\tID\tSTATUS\tSTAGE\tSINCE\tLAST RUN\tSTALE")
+	for i := range nodes {
+		node := &nodes[i]
+		provider, err := p.provider(node)
+		if err != nil {
+			return err
+		}
+		status, err := provider.Status(node)
+		if err != nil {
+			return err
+		}
+		state, err := p.nodeState(node)
+		if err != nil {
+			return err
+		}
+
+		if state == nil {
+			fmt.Fprintf(w, "%s\t%s\t\t%s\t\t\t\t\n", node.Name, node.Provider.Name, status)
+			continue
+		}
+		lastRun := ""
+		if state.LastCommand != "" {
+			lastRun = fmt.Sprintf("%s, exit %d", state.LastCommand, state.ExitStatus)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", node.Name, state.Provider, state.ID, status, state.Stage,
+			state.Timestamps[state.Stage].Format("2006-01-02 15:04:05"), lastRun, state.stale(node))
+	}
+	return w.Flush()
+}
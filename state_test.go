@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvisionerKey(t *testing.T) {
+	shell := Provisioner{Name: "shell", Content: "hostname"}
+	tests := []struct {
+		name     string
+		a, b     Provisioner
+		same     bool
+		expected string
+	}{
+		{
+			name:     "id based",
+			a:        Provisioner{Name: "shell", ID: "setup", Content: "hostname"},
+			b:        Provisioner{Name: "shell", ID: "setup", Content: "uptime"},
+			same:     true,
+			expected: "id-setup",
+		},
+		{
+			name:     "hash based",
+			a:        shell,
+			b:        Provisioner{Name: "shell", Content: "uptime"},
+			expected: "shell-",
+		},
+		{
+			name:     "run_once does not change key",
+			a:        shell,
+			b:        Provisioner{Name: "shell", Content: "hostname", RunOnce: true},
+			same:     true,
+			expected: "shell-",
+		},
+		{
+			name:     "skip_unchanged does not change key",
+			a:        shell,
+			b:        Provisioner{Name: "shell", Content: "hostname", SkipUnchanged: true},
+			same:     true,
+			expected: "shell-",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := provisionerKey(test.a), provisionerKey(test.b)
+			if !strings.HasPrefix(a, test.expected) {
+				t.Errorf("key %s, expected prefix %s", a, test.expected)
+			}
+			if (a == b) != test.same {
+				t.Errorf("keys %s and %s, expected same %v", a, b, test.same)
+			}
+		})
+	}
+}
+
+func TestProvisionerHash(t *testing.T) {
+	ansible := Provisioner{Name: "ansible", Playbook: "playbook/site.yml", Extravars: []string{"@vars.yml", "env=ci"}}
+	tests := []struct {
+		name        string
+		provisioner Provisioner
+		change      func(t *testing.T, dir string)
+		changed     bool
+	}{
+		{
+			name:        "playbook edit",
+			provisioner: ansible,
+			change:      writeTestFile("playbook/site.yml", "- hosts: web"),
+			changed:     true,
+		},
+		{
+			name:        "role edit",
+			provisioner: ansible,
+			change:      writeTestFile("playbook/roles/web/tasks/main.yml", "- debug: {msg: web}"),
+			changed:     true,
+		},
+		{
+			name:        "extra vars file edit",
+			provisioner: ansible,
+			change:      writeTestFile("vars.yml", "env: prod"),
+			changed:     true,
+		},
+		{
+			name:        "dot directory is ignored",
+			provisioner: ansible,
+			change:      writeTestFile("playbook/.git/HEAD", "ref: refs/heads/next"),
+		},
+		{
+			name:        "file outside playbook directory is ignored",
+			provisioner: ansible,
+			change:      writeTestFile("clover.yml", "nodes: []"),
+		},
+		{
+			name:        "ansible-local playbook is inside the node",
+			provisioner: Provisioner{Name: "ansible-local", Playbook: "playbook/site.yml"},
+			change:      writeTestFile("playbook/site.yml", "- hosts: web"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, write := range []func(*testing.T, string){
+				writeTestFile("clover.yml", "nodes: []"),
+				writeTestFile("vars.yml", "env: ci"),
+				writeTestFile("playbook/site.yml", "- hosts: all"),
+				writeTestFile("playbook/roles/web/tasks/main.yml", "- debug: {msg: all}"),
+				writeTestFile("playbook/.git/HEAD", "ref: refs/heads/master"),
+			} {
+				write(t, dir)
+			}
+			p := &project{configDir: dir}
+
+			before, err := p.provisionerHash(test.provisioner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.change(t, dir)
+			after, err := p.provisionerHash(test.provisioner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (before != after) != test.changed {
+				t.Errorf("hash changed %v, expected %v", before != after, test.changed)
+			}
+		})
+	}
+}
+
+// returns function writing file relative to the directory, creating its parent directories
+func writeTestFile(name, content string) func(t *testing.T, dir string) {
+	return func(t *testing.T, dir string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSkipProvisioner(t *testing.T) {
+	previous := map[string]string{"id-setup": "abc"}
+	tests := []struct {
+		name        string
+		provisioner Provisioner
+		hash        string
+		expected    string
+	}{
+		{"runs every time", Provisioner{}, "abc", ""},
+		{"run once after run", Provisioner{RunOnce: true}, "def", "it runs once"},
+		{"skip unchanged", Provisioner{SkipUnchanged: true}, "abc", "nothing changed since its last run"},
+		{"skip unchanged after change", Provisioner{SkipUnchanged: true}, "def", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if reason := skipProvisioner(test.provisioner, previous, "id-setup", test.hash); reason != test.expected {
+				t.Errorf("skip reason %q, expected %q", reason, test.expected)
+			}
+		})
+	}
+
+	// provisioner which never ran successfully is not skipped
+	for _, provisioner := range []Provisioner{{RunOnce: true}, {SkipUnchanged: true}} {
+		if reason := skipProvisioner(provisioner, previous, "id-other", "abc"); reason != "" {
+			t.Errorf("%+v: skip reason %q of provisioner which never ran", provisioner, reason)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/koding/vagrantutil"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+func init() {
+	registerProvider("static", newStaticProvider)
+}
+
+// staticProvider works with already running machines, connection details are taken from node.ssh
+type staticProvider struct {
+	project *project
+}
+
+func newStaticProvider(p *project, name string) (Provider, error) {
+	return &staticProvider{project: p}, nil
+}
+
+// static nodes are never created, only checked for reachability
+func (s *staticProvider) Create(node *nodeType) (err error) {
+	if err = os.MkdirAll(s.project.nodeDir(node), 0755); err != nil {
+		return
+	}
+	if err = s.reachable(node); err != nil {
+		return fmt.Errorf("node %s is not reachable on %s: %s", node.Name, s.address(node), err)
+	}
+	return
+}
+
+func (s *staticProvider) address(node *nodeType) string {
+	address, _ := s.Address(node)
+	return net.JoinHostPort(address.Host, strconv.Itoa(address.Port))
+}
+
+// node is running if ssh port accepts connections
+func (s *staticProvider) Status(node *nodeType) (vagrantutil.Status, error) {
+	if err := s.reachable(node); err != nil {
+		return vagrantutil.Unknown, nil
+	}
+	return vagrantutil.Running, nil
+}
+
+// connects to ssh port of the node, node behind proxy jump is reached only with ssh through the jump host
+func (s *staticProvider) reachable(node *nodeType) (err error) {
+	if node.SSH.ProxyJump == "" {
+		conn, err := net.DialTimeout("tcp", s.address(node), 5*time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	address, err := s.Address(node)
+	if err != nil {
+		return
+	}
+	client, err := sshConnection(address, newSSHRetry(node.SSH).connectTimeout, s.project.knownHosts(node))
+	if err != nil {
+		return
+	}
+	return client.Close()
+}
+
+func (s *staticProvider) Halt(node *nodeType) error {
+	return fmt.Errorf("node %s is static, it cannot be halted", node.Name)
+}
+
+// machine is left intact, only clover state is removed
+func (s *staticProvider) Destroy(node *nodeType) error {
+	return nil
+}
+
+func (s *staticProvider) Connect(node *nodeType) (Transport, error) {
+	return newSSHTransport(s.project, node, func() (sshItems, error) { return s.Address(node) }), nil
+}
+
+// returns node.ssh with defaults: port 22, current user, ~/.ssh/id_rsa key, which may be missing
+// if ssh agent or password is used
+func (s *staticProvider) Address(node *nodeType) (address sshItems, err error) {
+	address = sshItems{
+		Host:         node.SSH.Host,
+		User:         node.SSH.User,
+		Port:         node.SSH.Port,
+		IdentityFile: node.SSH.IdentityFile,
+		Password:     node.SSH.Password,
+		ProxyJump:    node.SSH.ProxyJump,
+	}
+	if address.Port == 0 {
+		address.Port = 22
+	}
+	if address.User == "" {
+		if current, err := user.Current(); err == nil {
+			address.User = current.Username
+		}
+	}
+	if address.IdentityFile == "" {
+		address.IdentityFile = "~/.ssh/id_rsa"
+	}
+	address.IdentityFile, err = homedir.Expand(address.IdentityFile)
+	return
+}
+
+// static node is identified by its ssh address
+func (s *staticProvider) ID(node *nodeType) string {
+	return s.address(node)
+}
+
+func (s *staticProvider) Login(node *nodeType) (err error) {
+	address, err := s.Address(node)
+	if err != nil {
+		return
+	}
+	return sshLogin(address, s.project.knownHosts(node))
+}
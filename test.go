@@ -0,0 +1,80 @@
+package main
+
+import "fmt"
+
+// destroy modes of test command, same as in test-kitchen
+const (
+	destroyAlways  = "always"
+	destroyPassing = "passing"
+	destroyNever   = "never"
+)
+
+func testConverge(p *project, node *nodeType) (result nodeResult) {
+	fmt.Fprintln(node.outWriter(), "*** Converging node", node.Name)
+	if err := converge(p, node); err != nil {
+		result.stage, result.err = "converge", err
+	}
+	return
+}
+
+// verifies converged node and destroys it according to destroy mode
+func testFinish(p *project, node *nodeType, destroyMode string, result nodeResult) nodeResult {
+	if result.err == nil && node.Verifier.Name == "" {
+		fmt.Fprintln(node.outWriter(), "*** No verifier defined for node", node.Name)
+		result.skipped = "verify"
+	} else if result.err == nil {
+		fmt.Fprintln(node.outWriter(), "*** Verifying node", node.Name)
+		if err := node.verify(p); err != nil {
+			result.stage, result.err = "verify", err
+		}
+	}
+
+	if destroyMode == destroyAlways || (destroyMode == destroyPassing && result.err == nil) {
+		fmt.Fprintln(node.outWriter(), "*** Destroying node", node.Name)
+		if err := destroy(p, node); err != nil && result.err == nil {
+			result.stage, result.err = "destroy", err
+		}
+	}
+	return result
+}
+
+// runs test cycle for every node, failure of one node does not stop the others, top level
+// provisioners run only if all nodes are tested, the same as on converge
+func runTests(p *project, nodes []nodeType, all bool, destroyMode string, concurrency int) (results []nodeResult, err error) {
+	if destroyMode != destroyAlways && destroyMode != destroyPassing && destroyMode != destroyNever {
+		err = fmt.Errorf("destroy mode must be one of %s, %s, %s", destroyAlways, destroyPassing, destroyNever)
+		return
+	}
+
+	if len(p.conf.Provisioner) == 0 || !all {
+		results = runNodes(nodes, concurrency, func(node *nodeType) nodeResult {
+			return testFinish(p, node, destroyMode, testConverge(p, node))
+		})
+		return
+	}
+
+	// top level provisioners need all nodes converged before any of them is verified
+	converged := runNodes(nodes, concurrency, func(node *nodeType) nodeResult {
+		return testConverge(p, node)
+	})
+	if err := provisionAll(p); err != nil {
+		for i := range converged {
+			if converged[i].err == nil {
+				converged[i].stage, converged[i].err = "provision", err
+			}
+		}
+	}
+
+	results = runNodes(nodes, concurrency, func(node *nodeType) nodeResult {
+		for _, result := range converged {
+			if result.node == node.Name {
+				return testFinish(p, node, destroyMode, result)
+			}
+		}
+		return nodeResult{}
+	})
+	for i := range results {
+		results[i].duration += converged[i].duration
+	}
+	return
+}
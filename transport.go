@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Transport runs commands on the node with root privileges and uploads files into it; transports are
+// shared by everything a command does with the node, so output goes to writers of the caller
+type Transport interface {
+	// Run runs command, its output is written to stdout unless it is nil, errors to stderr
+	Run(cmd string, stdout, stderr io.Writer) error
+	// Output runs command and returns its output, errors are written to stderr
+	Output(cmd string, stderr io.Writer) ([]byte, error)
+	Upload(path string, content []byte, stderr io.Writer) error
+	Close() error
+}
+
+// execTransport runs commands through local executable, e.g. "docker exec -i <container>"
+type execTransport struct {
+	prefix []string
+}
+
+func newExecTransport(prefix ...string) *execTransport {
+	return &execTransport{prefix: prefix}
+}
+
+func (t *execTransport) command(cmd string) *exec.Cmd {
+	args := append(append([]string{}, t.prefix[1:]...), "sh", "-c", cmd)
+	return exec.Command(t.prefix[0], args...)
+}
+
+func (t *execTransport) Run(cmd string, stdout, stderr io.Writer) (err error) {
+	c := t.command(cmd)
+	c.Stdout = stdout
+	c.Stderr = stderr
+	return c.Run()
+}
+
+func (t *execTransport) Output(cmd string, stderr io.Writer) ([]byte, error) {
+	c := t.command(cmd)
+	c.Stderr = stderr
+	return c.Output()
+}
+
+func (t *execTransport) Upload(path string, content []byte, stderr io.Writer) (err error) {
+	c := t.command(fmt.Sprintf("mkdir -p %s && cat > %s", shellQuote(filepath.Dir(path)), shellQuote(path)))
+	c.Stdin = bytes.NewReader(content)
+	c.Stderr = stderr
+	return c.Run()
+}
+
+func (t *execTransport) Close() error {
+	return nil
+}
+
+// returns transport of the node shared by everything the command does with it, e.g. converge, inventory
+// and /etc/hosts updates, so ssh connection is opened once; closeTransports closes it
+func (p *project) transport(node *nodeType) (transport Transport, err error) {
+	p.mu.Lock()
+	transport = p.transports[node.Name]
+	p.mu.Unlock()
+	if transport != nil {
+		return
+	}
+
+	// provider may run commands to connect, e.g. nspawn, node is reached without p.mu
+	provider, err := p.provider(node)
+	if err != nil {
+		return
+	}
+	if transport, err = provider.Connect(node); err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cached := p.transports[node.Name]; cached != nil {
+		transport.Close()
+		return cached, nil
+	}
+	if p.transports == nil {
+		p.transports = map[string]Transport{}
+	}
+	p.transports[node.Name] = transport
+	return
+}
+
+// closes and drops transport of the node, e.g. after it was recreated or destroyed
+func (p *project) closeTransport(node *nodeType) {
+	p.mu.Lock()
+	transport := p.transports[node.Name]
+	delete(p.transports, node.Name)
+	p.mu.Unlock()
+	// connecting transport holds its own lock, others are not blocked meanwhile
+	if transport != nil {
+		transport.Close()
+	}
+}
+
+// closes transports of all nodes at the end of the command
+func (p *project) closeTransports() {
+	p.mu.Lock()
+	transports := p.transports
+	p.transports = nil
+	p.mu.Unlock()
+	for _, transport := range transports {
+		transport.Close()
+	}
+}
+
+// quotes string for POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// output of shared transport goes to writers of the node running the command, e.g. prefixed ones of
+// concurrently converged nodes, not to writers of the node the transport was created for
+func TestTransportOutputPrefixed(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+
+	// transports were cached by /etc/hosts update of another node
+	p := &project{transports: map[string]Transport{"web": newExecTransport("env"), "db": newExecTransport("env")}}
+	nodes := []nodeType{{Name: "web"}, {Name: "db"}}
+	results := runNodes(nodes, 2, func(node *nodeType) nodeResult {
+		transport, err := p.transport(node)
+		if err == nil {
+			err = transport.Run("echo ran "+node.Name+"; echo failed "+node.Name+" >&2; printf partial", node.outWriter(), node.errWriter())
+		}
+		return nodeResult{err: err}
+	})
+	w.Close()
+	os.Stdout, os.Stderr = stdout, stderr
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, result := range results {
+		if result.err != nil {
+			t.Fatalf("%s: %s", result.node, result.err)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	sort.Strings(lines)
+	expected := []string{"[db] failed db", "[db] partial", "[db] ran db", "[web] failed web", "[web] partial", "[web] ran web"}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("output\n%s\nexpected\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+}
@@ -2,64 +2,184 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"html/template"
-	"log"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 
 	"github.com/koding/vagrantutil"
 	homedir "github.com/mitchellh/go-homedir"
 )
 
+func init() {
+	registerProvider("vagrant", newVagrantProvider)
+}
+
 type sshItems struct {
 	Host         string
 	User         string
 	Port         int
 	IdentityFile string
+	// password auth and [<user>@]<host>[:<port>] jump host, set for static nodes
+	Password  string
+	ProxyJump string
+	// ansible connection plugin, ssh if empty
+	Connection string
 }
 
 const vagrantTemplate = `Vagrant.configure(2) do |config|
 {{ range .Nodes }}
-  config.vm.define "{{ .Name }}" do |{{ .Name }}|
+  config.vm.define "{{ .Name }}" do |node|
 	{{ $name := .Name }}
-    {{ .Name }}.vm.box = "{{ .Provider.Box }}"
-    {{ .Name }}.vm.hostname = "{{ .Name }}"
+    node.vm.box = "{{ .Provider.Box }}"
+	{{- if .Provider.BoxVersion }}
+    node.vm.box_version = "{{ .Provider.BoxVersion }}"
+	{{- end }}
+	{{- if .Provider.BoxURL }}
+    node.vm.box_url = "{{ .Provider.BoxURL }}"
+	{{- end }}
+    node.vm.hostname = "{{ .Name }}"
 	## network
 	{{ range .Provider.Network.ForwardedPort -}}
 	{{ $list := split . ":" -}}
 	{{ if eq (len $list) 5 }}
-	{{- $name }}.vm.network "forwarded_port", guest_ip: "{{ index $list 2}}", guest: {{ index $list 3}}, host_ip: "{{ index $list 0}}", host: {{ index $list 1}}, protocol: "{{ index $list 4 -}}"
+	node.vm.network "forwarded_port", guest_ip: "{{ index $list 2}}", guest: {{ index $list 3}}, host_ip: "{{ index $list 0}}", host: {{ index $list 1}}, protocol: "{{ index $list 4 -}}"
 	{{ end }}
 	{{ if eq (len $list) 3 }}
-	{{- $name }}.vm.network "forwarded_port", guest_ip: "127.0.0.1", guest: {{ index $list 1}}, host_ip: "127.0.0.1", host: {{ index $list 0}}, protocol: "{{ index $list 2 -}}"
+	node.vm.network "forwarded_port", guest_ip: "127.0.0.1", guest: {{ index $list 1}}, host_ip: "127.0.0.1", host: {{ index $list 0}}, protocol: "{{ index $list 2 -}}"
 	{{ end }}
 	{{- end }}
+	{{- range .Provider.Network.PrivateNetwork }}
+	node.vm.network "private_network", {{ if .IP }}ip: "{{ .IP }}"{{ else }}type: "dhcp"{{ end }}
+	{{- end }}
+	{{- range .Provider.Network.PublicNetwork }}
+	node.vm.network "public_network"{{ if .IP }}, ip: "{{ .IP }}"{{ end }}{{ if .Bridge }}, bridge: "{{ .Bridge }}"{{ end }}
+	{{- end }}
 	## synced folders
-	{{ $name }}.vm.synced_folder ".", "/vagrant", disabled: true
-	{{ $name }}.vm.synced_folder "{{ $name }}", "/clover"
+	node.vm.synced_folder ".", "/vagrant", disabled: true
+	node.vm.synced_folder "{{ $name }}", "/clover"
 	{{ range .Provider.SyncedFolders -}}
 	{{ $list := resolveDir . }}
-	{{ $name }}.vm.synced_folder "{{ index $list 0}}", "{{ index $list 1}}"
-	{{ end }}
-	## shell
-	{{ range .Provisioner }}
-	{{ if eq .Name "ansible-local" -}}
-	{{ $name }}.vm.provision "shell", path: "ansible.sh"
-	{{ if .Playbook -}}
-	{{ $name }}.vm.provision "shell", inline: "ansible-playbook {{ .Playbook }}"
-	{{ end }}
-	{{ end }}
+	node.vm.synced_folder "{{ index $list 0}}", "{{ index $list 1}}"
 	{{ end }}
+	{{- range .Provider.Disks }}
+	node.vm.disk :disk, name: "{{ .Name }}", size: "{{ .Size }}"
+	{{- end }}
+	{{- range $provider, $lines := providerSettings .Provider }}
+	node.vm.provider "{{ $provider }}" do |p|
+	{{- range $lines }}
+	  {{ . }}
+	{{- end }}
+	end
+	{{- end }}
   end
 {{ end }}
 end`
 
+// vagrant providers cpus, memory and disks are set for
+var resourceProviders = []string{"virtualbox", "libvirt"}
+
+// returns ruby lines of node.vm.provider blocks keyed by vagrant provider name, customize values
+// which are lists of lists are method calls, e.g. virtualbox customize, other values are assigned
+func providerSettings(provider providerType) map[string][]string {
+	settings := map[string][]string{}
+	for _, name := range resourceProviders {
+		if provider.Cpus > 0 {
+			settings[name] = append(settings[name], fmt.Sprintf("p.cpus = %d", provider.Cpus))
+		}
+		if provider.Memory > 0 {
+			settings[name] = append(settings[name], fmt.Sprintf("p.memory = %d", provider.Memory))
+		}
+	}
+	// vm.disk is not supported by libvirt
+	for _, disk := range provider.Disks {
+		settings["libvirt"] = append(settings["libvirt"], fmt.Sprintf("p.storage :file, size: %s", rubyValue(strings.TrimSuffix(disk.Size, "B"))))
+	}
+
+	for name, customize := range provider.Customize {
+		keys := make([]string, 0, len(customize))
+		for key := range customize {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if calls, ok := methodCalls(customize[key]); ok {
+				for _, args := range calls {
+					settings[name] = append(settings[name], fmt.Sprintf("p.%s %s", key, rubyValue(args)))
+				}
+			} else {
+				settings[name] = append(settings[name], fmt.Sprintf("p.%s = %s", key, rubyValue(customize[key])))
+			}
+		}
+	}
+	return settings
+}
+
+// returns arguments of method calls if value is list of lists
+func methodCalls(value interface{}) (calls []interface{}, ok bool) {
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, false
+	}
+	for _, item := range list {
+		if _, ok = item.([]interface{}); !ok {
+			return nil, false
+		}
+	}
+	return list, true
+}
+
+// returns ruby literal of yaml value, strings starting with colon are symbols, e.g. :id
+func rubyValue(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		if rubySymbolRegexp.MatchString(value) {
+			return value
+		}
+		return strings.ReplaceAll(strconv.Quote(value), "#", `\#`)
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			items[i] = rubyValue(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := make([]string, len(keys))
+		for i, key := range keys {
+			items[i] = fmt.Sprintf("%s => %s", strconv.Quote(key), rubyValue(value[key]))
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case nil:
+		return "nil"
+	}
+	return fmt.Sprint(value)
+}
+
+var rubySymbolRegexp = regexp.MustCompile(`^:[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// vagrant requires experimental flag for vm.disk
+func vagrantDisks(conf *configType) bool {
+	for _, node := range conf.Nodes {
+		if node.Provider.Name == "vagrant" && len(node.Provider.Disks) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // converts "<hostdir>:<vmdir>" string into slice of strings with absolute paths
 func resolveDir(dirPath string) (dirs []string, err error) {
 	dirList := strings.Split(dirPath, ":")
@@ -85,22 +205,26 @@ func resolveDir(dirPath string) (dirs []string, err error) {
 	return
 }
 
-func generateVagrantConfig(configFile string) (vagrantConfig string, err error) {
-	conf, err := getConf(configFile)
-	if err != nil {
-		fmt.Println("Error:", err)
-		os.Exit(1)
+func generateVagrantConfig(conf *configType) (vagrantConfig string, err error) {
+	// containers and other providers are not part of Vagrantfile
+	var vagrantConf configType
+	for _, node := range conf.Nodes {
+		if node.Provider.Name == "vagrant" {
+			vagrantConf.Nodes = append(vagrantConf.Nodes, node)
+		}
 	}
+
 	var tpl bytes.Buffer
 	funcMap := template.FuncMap{
-		"split":      strings.Split,
-		"resolveDir": resolveDir,
+		"split":            strings.Split,
+		"resolveDir":       resolveDir,
+		"providerSettings": providerSettings,
 	}
 	vc, err := template.New("vagrant").Funcs(funcMap).Parse(vagrantTemplate)
 	if err != nil {
-		fmt.Println("Error:", err)
+		return
 	}
-	err = vc.Execute(&tpl, conf)
+	err = vc.Execute(&tpl, vagrantConf)
 	vagrantConfig = tpl.String()
 	return
 }
@@ -116,236 +240,240 @@ func getVagrantDir(configFile string) (vagrantDir string, err error) {
 	return
 }
 
-func convergeVagrant(node *nodeType, configFile string) (err error) {
-	var vagrantConfig string
-	// if Vagrantfile does not exist, generate one and any shell script defined
-	if _, err = os.Stat(fmt.Sprintf("%s/Vagrantfile", vagrantDir)); os.IsNotExist(err) {
-		vagrantConfig, err = generateVagrantConfig(configFile)
-		if err != nil {
-			return
-		}
-
+// returns state directory of the project, named after project key or the only configuration file
+func getStateDir(conf *configType, configFiles []string) (stateDir string, err error) {
+	if conf.Project != "" {
+		return "." + conf.Project, nil
+	}
+	if len(configFiles) > 1 {
+		return "", errors.New("project must be set when configuration is combined from several files")
 	}
+	return getVagrantDir(configFiles[0])
+}
 
-	vagrantDir, err = getVagrantDir(configFile)
-	if err != nil {
+// vagrantProvider runs all vagrant nodes of the project from single Vagrantfile in state directory
+type vagrantProvider struct {
+	project *project
+}
+
+func newVagrantProvider(p *project, name string) (provider Provider, err error) {
+	if err = execInstalled("vagrant", "version"); err != nil {
 		return
 	}
+	return &vagrantProvider{project: p}, nil
+}
 
-	vagrant, err := vagrantutil.NewVagrant(vagrantDir)
-	if err != nil {
-		return
+// returns vagrant command to be run in state directory
+func (v *vagrantProvider) command(args ...string) *exec.Cmd {
+	cmd := exec.Command("vagrant", args...)
+	cmd.Dir = v.project.stateDir
+	if vagrantDisks(v.project.conf) {
+		cmd.Env = append(os.Environ(), "VAGRANT_EXPERIMENTAL=disks")
+	}
+	return cmd
+}
+
+func (v *vagrantProvider) run(node *nodeType, args ...string) (err error) {
+	cmd := v.command(args...)
+	cmd.Stdout = node.outWriter()
+	cmd.Stderr = node.errWriter()
+	return cmd.Run()
+}
+
+// vagrant machine states, as reported by "vagrant status --machine-readable"
+var vagrantStates = map[string]vagrantutil.Status{
+	"not_created": vagrantutil.NotCreated,
+	"running":     vagrantutil.Running,
+	"saved":       vagrantutil.Saved,
+	"paused":      vagrantutil.Saved,
+	"poweroff":    vagrantutil.PowerOff,
+	"shutoff":     vagrantutil.PowerOff,
+	"aborted":     vagrantutil.Aborted,
+	"preparing":   vagrantutil.Preparing,
+}
+
+func (v *vagrantProvider) Status(node *nodeType) (status vagrantutil.Status, err error) {
+	if _, statErr := os.Stat(filepath.Join(v.project.stateDir, "Vagrantfile")); os.IsNotExist(statErr) {
+		return vagrantutil.NotCreated, nil
 	}
 
-	err = vagrant.Create(vagrantConfig)
+	out, err := v.command("status", node.Name, "--machine-readable").Output()
 	if err != nil {
-		return
+		return vagrantutil.Unknown, err
 	}
 
-	// .<vagrantDir>/<node.Name>
-	nodeDir := filepath.Join(vagrantDir, node.Name)
-	if _, statErr := os.Stat(nodeDir); os.IsNotExist(statErr) {
-		err = os.Mkdir(nodeDir, 0755)
-		if err != nil {
-			return
+	// <timestamp>,<target>,state,<state>
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) >= 4 && fields[1] == node.Name && fields[2] == "state" {
+			if status, ok := vagrantStates[fields[3]]; ok {
+				return status, nil
+			}
 		}
 	}
+	return vagrantutil.Unknown, nil
+}
 
-	// install stage tasks
-	for _, provisioner := range node.Provisioner {
-
-		// generate ansible installation script for ansible-local provider before vagrant up
-		if provisioner.Name == "ansible-local" {
-			if _, err = os.Stat(filepath.Join(nodeDir, "ansible.sh")); os.IsNotExist(err) {
-				os.Chdir(nodeDir)
+// returns hash of the node section of Vagrantfile
+func vagrantNodeHash(node *nodeType) string {
+	section, err := generateVagrantConfig(&configType{Nodes: []nodeType{*node}})
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(section)))
+}
 
-				if err = writeFile("ansible.sh", ansiblesh); err != nil {
-					fmt.Println("Error:", err)
-				}
-				os.Chdir("../..")
-			}
-		}
+// compares Vagrantfile with configuration and shows the difference, with reload Vagrantfile
+// is regenerated, otherwise changed Vagrantfile is an error
+func (v *vagrantProvider) regenerate(reload bool) (changed bool, err error) {
+	v.project.mu.Lock()
+	defer v.project.mu.Unlock()
+
+	path := filepath.Join(v.project.stateDir, "Vagrantfile")
+	current, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// it is generated on converge
+		return false, nil
+	} else if err != nil {
+		return
+	}
+	vagrantConfig, err := generateVagrantConfig(v.project.conf)
+	if err != nil || string(current) == vagrantConfig {
+		return
 	}
 
-	// run vagrant up if not created, provision if it is running
-	status, _ := vagrant.Status()
-	if status.String() == "NotCreated" {
-		output, err := vagrant.Up()
+	fmt.Printf("Vagrantfile in %s does not match %s:\n", v.project.stateDir, v.project.configFile)
+	fmt.Print(lineDiff(string(current), vagrantConfig))
+	if !reload {
+		err = fmt.Errorf("Vagrantfile is out of date, run with --reload to regenerate it and reload changed nodes, or destroy and converge them")
+		return
+	}
+	return true, writeFile(path, vagrantConfig)
+}
 
+// regenerates Vagrantfile if configuration changed and reloads given running nodes whose section
+// changed; Vagrantfile has to be written before reload, so nodes still to be reloaded are found
+// by Vagrantfile section hash recorded in their state, failed or skipped reload is retried later
+func (v *vagrantProvider) Drift(nodes []nodeType, reload bool) (err error) {
+	var pending []*nodeType
+	for i := range nodes {
+		node := &nodes[i]
+		if node.Provider.Name != "vagrant" {
+			continue
+		}
+		state, err := v.project.nodeState(node)
 		if err != nil {
 			return err
 		}
-
-		for line := range output {
-			log.Println(line.Line)
+		if state == nil || state.Hashes["vagrantfile"] == "" || state.Hashes["vagrantfile"] == vagrantNodeHash(node) {
+			continue
 		}
-
-	} else if status.String() == "Running" {
-		os.Chdir(vagrantDir)
-
-		cmd := exec.Command("vagrant", "provision")
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
-		if err != nil {
-			return
+		if status, err := v.Status(node); err != nil || status != vagrantutil.Running {
+			continue
 		}
-		os.Chdir("..")
-	} else {
-		return fmt.Errorf("State is %s, destroy and run converge again", status)
+		pending = append(pending, node)
 	}
 
-	sftpClient, err := node.sftpConn(vagrantDir)
-	if err != nil {
-		sftpClient.Close()
-		return err
+	if _, err = v.regenerate(reload); err != nil {
+		return
 	}
-	defer sftpClient.Close()
-
-	// create tmp dir
-	if _, err = sftpClient.Lstat(".clover"); os.IsNotExist(err) {
-		if err = sftpClient.Mkdir(".clover"); err != nil {
-			return
+	if len(pending) > 0 && !reload {
+		var names []string
+		for _, node := range pending {
+			names = append(names, node.Name)
 		}
+		return fmt.Errorf("nodes %s run with outdated Vagrantfile section, run with --reload to reload them, or destroy and converge them", strings.Join(names, ", "))
 	}
 
-	// uploading files
-	for _, file := range node.Files {
-
-		// check if file exists
-		if _, err = sftpClient.Lstat(file.Path); os.IsNotExist(err) {
-
-			// upload file into temporary location
-			tmpFileName := randFileName()
-			f, err := sftpClient.Create(sftpClient.Join(".clover", tmpFileName))
-			if err != nil {
-				return err
-			}
-			if _, err := f.Write([]byte(file.Content)); err != nil {
-				return err
-			}
-			f.Close()
-
-			// create dir if not exists
-			if _, err = sftpClient.Lstat(filepath.Dir(file.Path)); os.IsNotExist(err) {
-				if err = node.sshCommand(vagrantDir, fmt.Sprintf("sudo mkdir -p %s", filepath.Dir(file.Path)), false); err != nil {
-					return err
-				}
-			}
-
-			// move temprorary file into destination
-			if err = node.sshCommand(vagrantDir, fmt.Sprintf("sudo mv %s %s", sftpClient.Join(".clover", tmpFileName), file.Path), false); err != nil {
-				return err
-			}
-
-			// reset owner and group
-			if file.User != "" && file.Group != "" {
-				if err = node.sshCommand(vagrantDir, fmt.Sprintf("sudo chown %s:%s %s", file.User, file.Group, file.Path), false); err != nil {
-					return err
-				}
-			}
-
-			// reset mode
-			if file.Mode != 0 {
-				if err = node.sshCommand(vagrantDir, fmt.Sprintf("sudo chmod %d %s", file.Mode, file.Path), false); err != nil {
-					return err
-				}
-
-			}
-
+	for _, node := range pending {
+		fmt.Println("*** Reloading node", node.Name)
+		if err = v.run(node, "reload", node.Name); err != nil {
+			return err
+		}
+		v.project.forgetHost(node)
+		if err = v.recordHashes(node); err != nil {
+			return err
 		}
 	}
+	return
+}
 
-	// converge stage tasks
-	for i, provisioner := range node.Provisioner {
-
-		// ansible provisioner
-		if provisioner.Name == "ansible" {
-			if err = execInstalled("ansible-playbook", "--version"); err != nil {
-				return
-			}
-
-			if err = generateAnsibleHosts(node.Name, provisioner, vagrantDir); err != nil {
-				return
-			}
+// records Vagrantfile section and provider configuration the node runs with
+func (v *vagrantProvider) recordHashes(node *nodeType) error {
+	return v.project.updateState(node, func(state *nodeState) *nodeState {
+		state.Hashes["vagrantfile"] = vagrantNodeHash(node)
+		state.Hashes["provider"] = nodeHashes(node)["provider"]
+		return state
+	})
+}
 
-			fmt.Printf("Provisioning %s node with ansible:\n", node.Name)
+// generates Vagrantfile if it does not exist, it is shared by all vagrant nodes
+func (v *vagrantProvider) vagrantfile() (err error) {
+	v.project.mu.Lock()
+	defer v.project.mu.Unlock()
 
-			var cmd *exec.Cmd
-			argsRaw := []string{"-i", fmt.Sprintf("%s/ansiblehosts_%s", vagrantDir, node.Name), provisioner.Playbook}
-			if len(provisioner.Extravars) > 0 {
-				var extraVars []string
-				for _, i := range provisioner.Extravars {
-					extraVars = append(extraVars, "--extra-vars")
-					extraVars = append(extraVars, i)
-				}
-				argsRaw = append(argsRaw, extraVars...)
-			}
+	if _, statErr := os.Stat(filepath.Join(v.project.stateDir, "Vagrantfile")); !os.IsNotExist(statErr) {
+		return
+	}
 
-			fmt.Println("    ", "ansible-playbook", strings.Join(argsRaw, " "))
-			cmd = exec.Command("ansible-playbook", argsRaw...)
+	vagrantConfig, err := generateVagrantConfig(v.project.conf)
+	if err != nil {
+		return
+	}
 
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
-			if err != nil {
-				return
-			}
-		}
+	vagrant, err := vagrantutil.NewVagrant(v.project.stateDir)
+	if err != nil {
+		return
+	}
+	return vagrant.Create(vagrantConfig)
+}
 
-		// shell provisioners
-		if provisioner.Name == "shell" {
-
-			// put sh script into .<vagrantDir>/<nodeName> which is mounted into
-			if node.Provider.Name == "vagrant" {
-				if _, err = os.Stat(filepath.Join(nodeDir, fmt.Sprintf("%d.sh", i))); os.IsNotExist(err) {
-					os.Chdir(nodeDir)
-					err = writeFile(fmt.Sprintf("%d.sh", i), provisioner.Content)
-					if err != nil {
-						return
-					}
-					os.Chdir("../..")
-				}
-			}
+// generates Vagrantfile if it does not exist and brings machine up
+func (v *vagrantProvider) Create(node *nodeType) (err error) {
+	if err = v.vagrantfile(); err != nil {
+		return
+	}
 
-			// generate shell script
-			f, err := sftpClient.Create(sftpClient.Join(".clover", fmt.Sprintf("%d.sh", i)))
-			if err != nil {
-				return err
-			}
-			if _, err := f.Write([]byte(provisioner.Content)); err != nil {
-				return err
-			}
-			f.Close()
+	// .<stateDir>/<node.Name>, mounted into vm as /clover
+	if err = os.MkdirAll(v.project.nodeDir(node), 0755); err != nil {
+		return
+	}
 
-			node.sshCommand(vagrantDir, "sudo bash "+filepath.Join(".clover", fmt.Sprintf("%d.sh", i)), true)
+	// run vagrant up if not created or stopped
+	status, err := v.Status(node)
+	if err != nil {
+		return
+	}
+	switch status {
+	case vagrantutil.NotCreated, vagrantutil.PowerOff, vagrantutil.Saved:
+		if err = v.run(node, "up", node.Name); err != nil {
+			return
 		}
+		return v.recordHashes(node)
+	case vagrantutil.Running:
+		return
 	}
+	return fmt.Errorf("State is %s, destroy and run converge again", status)
+}
 
-	return
+func (v *vagrantProvider) Halt(node *nodeType) error {
+	return v.run(node, "halt", node.Name)
 }
 
-func sshVagrant(vmName string, configFile string) (err error) {
-	vagrantDir, err = getVagrantDir(configFile)
-	if err != nil {
+func (v *vagrantProvider) Destroy(node *nodeType) (err error) {
+	status, err := v.Status(node)
+	if err != nil || status == vagrantutil.NotCreated {
 		return
 	}
-	os.Chdir(vagrantDir)
-	defer os.Chdir("..")
-	cmd := exec.Command("vagrant", "ssh", vmName)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
-	return
+	return v.run(node, "destroy", "--force", node.Name)
 }
 
-func getVagrantSSHDetails(vagrantDir string, vmName string) (sshConn sshItems, err error) {
-	os.Chdir(vagrantDir)
-	defer os.Chdir("..")
-	out, err := exec.Command("vagrant", "ssh-config", vmName).Output()
+func (v *vagrantProvider) Connect(node *nodeType) (Transport, error) {
+	return newSSHTransport(v.project, node, func() (sshItems, error) { return v.Address(node) }), nil
+}
+
+func (v *vagrantProvider) Address(node *nodeType) (sshConn sshItems, err error) {
+	out, err := v.command("ssh-config", node.Name).Output()
 	if err != nil {
 		return
 	}
@@ -368,3 +496,23 @@ func getVagrantSSHDetails(vagrantDir string, vmName string) (sshConn sshItems, e
 	}
 	return
 }
+
+// returns machine id of the underlying hypervisor, .vagrant/machines/<node>/<provider>/id
+func (v *vagrantProvider) ID(node *nodeType) string {
+	files, _ := filepath.Glob(filepath.Join(v.project.stateDir, ".vagrant", "machines", node.Name, "*", "id"))
+	for _, file := range files {
+		if id, err := ioutil.ReadFile(file); err == nil {
+			return strings.TrimSpace(string(id))
+		}
+	}
+	return node.Name
+}
+
+// ssh is run directly instead of vagrant ssh, which does not verify host keys
+func (v *vagrantProvider) Login(node *nodeType) (err error) {
+	address, err := v.Address(node)
+	if err != nil {
+		return
+	}
+	return sshLogin(address, v.project.knownHosts(node))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fake vagrant logging its arguments, status reports state of CLOVER_TEST_VAGRANT_STATE
+const fakeVagrant = `#!/bin/sh
+echo "$@" >> "$CLOVER_TEST_VAGRANT_LOG"
+if [ "$1" = status ]; then
+	echo "1,$2,state,$CLOVER_TEST_VAGRANT_STATE"
+fi
+`
+
+func TestVagrantDrift(t *testing.T) {
+	tests := []struct {
+		name string
+		// vagrantfile hash recorded in state, current one if empty
+		recorded string
+		state    string
+		reload   bool
+		err      string
+		commands []string
+		// node is still to be reloaded on the next run
+		pending bool
+	}{
+		{
+			name:  "up to date",
+			state: "running",
+		},
+		{
+			name:     "pending reload without --reload",
+			recorded: "outdated",
+			state:    "running",
+			err:      "nodes web run with outdated Vagrantfile section, run with --reload to reload them, or destroy and converge them",
+			commands: []string{"status web --machine-readable"},
+			pending:  true,
+		},
+		{
+			name:     "pending reload with --reload",
+			recorded: "outdated",
+			state:    "running",
+			reload:   true,
+			commands: []string{"status web --machine-readable", "reload web"},
+		},
+		{
+			name:     "stopped node is reloaded when it runs",
+			recorded: "outdated",
+			state:    "poweroff",
+			reload:   true,
+			commands: []string{"status web --machine-readable"},
+			pending:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bin, dir := t.TempDir(), t.TempDir()
+			if err := ioutil.WriteFile(filepath.Join(bin, "vagrant"), []byte(fakeVagrant), 0755); err != nil {
+				t.Fatal(err)
+			}
+			log := filepath.Join(dir, "vagrant.log")
+			t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+			t.Setenv("CLOVER_TEST_VAGRANT_LOG", log)
+			t.Setenv("CLOVER_TEST_VAGRANT_STATE", test.state)
+
+			conf := configType{Nodes: []nodeType{{Name: "web", Provider: providerType{Name: "vagrant", Box: "debian/bookworm64"}}}}
+			p := &project{conf: &conf, configFile: "clover.yml", stateDir: dir}
+			node := &conf.Nodes[0]
+			vagrantConfig, err := generateVagrantConfig(&conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = writeFile(filepath.Join(dir, "Vagrantfile"), vagrantConfig); err != nil {
+				t.Fatal(err)
+			}
+			recorded := test.recorded
+			if recorded == "" {
+				recorded = vagrantNodeHash(node)
+			}
+			err = p.updateState(node, func(state *nodeState) *nodeState {
+				state.Hashes["vagrantfile"] = recorded
+				return state
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = (&vagrantProvider{project: p}).Drift(conf.Nodes, test.reload)
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			} else if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Fatalf("error %v, expected %s", err, test.err)
+			}
+
+			data, err := ioutil.ReadFile(log)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			commands := strings.Split(strings.TrimSpace(string(data)), "\n")
+			if len(data) == 0 {
+				commands = nil
+			}
+			if strings.Join(commands, "; ") != strings.Join(test.commands, "; ") {
+				t.Errorf("vagrant commands %q, expected %q", commands, test.commands)
+			}
+
+			state, err := p.nodeState(node)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pending := state.Hashes["vagrantfile"] != vagrantNodeHash(node); pending != test.pending {
+				t.Errorf("reload pending %v, expected %v", pending, test.pending)
+			}
+		})
+	}
+}
+
+func TestProviderSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		expected map[string][]string
+	}{
+		{
+			name:     "resources",
+			provider: `{cpus: 2, memory: 1024, disks: [{name: data, size: 10GB}]}`,
+			expected: map[string][]string{
+				"virtualbox": {"p.cpus = 2", "p.memory = 1024"},
+				"libvirt":    {"p.cpus = 2", "p.memory = 1024", `p.storage :file, size: "10G"`},
+			},
+		},
+		{
+			name: "scalars",
+			provider: `
+customize:
+  libvirt: {driver: kvm, cpu_mode: ":host_passthrough", nested: true, video_vram: 64, title: "#{name}", machine_type: null}
+`,
+			expected: map[string][]string{
+				"libvirt": {
+					"p.cpu_mode = :host_passthrough",
+					`p.driver = "kvm"`,
+					`p.machine_type = nil`,
+					"p.nested = true",
+					`p.title = "\#{name}"`,
+					"p.video_vram = 64",
+				},
+			},
+		},
+		{
+			name: "lists and nested maps",
+			provider: `
+customize:
+  docker: {ports: ["80:80", 443], create_args: {network: host, labels: {app: web}}}
+`,
+			expected: map[string][]string{
+				"docker": {
+					`p.create_args = {"labels" => {"app" => "web"}, "network" => "host"}`,
+					`p.ports = ["80:80", 443]`,
+				},
+			},
+		},
+		{
+			name: "method calls",
+			provider: `
+customize:
+  virtualbox:
+    customize:
+      - [modifyvm, ":id", --nictype1, virtio]
+      - [modifyvm, ":id", --audio, none]
+`,
+			expected: map[string][]string{
+				"virtualbox": {
+					`p.customize ["modifyvm", :id, "--nictype1", "virtio"]`,
+					`p.customize ["modifyvm", :id, "--audio", "none"]`,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var provider providerType
+			if err := yaml.Unmarshal([]byte(test.provider), &provider); err != nil {
+				t.Fatal(err)
+			}
+			if settings := providerSettings(provider); !reflect.DeepEqual(settings, test.expected) {
+				t.Errorf("settings\n%q\nexpected\n%q", settings, test.expected)
+			}
+		})
+	}
+}
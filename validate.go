@@ -0,0 +1,490 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configError is a problem in configuration file at line and column of the key or value
+type configError struct {
+	file         string
+	line, column int
+	msg          string
+}
+
+func (e *configError) Error() string {
+	if e.file == "" {
+		return e.msg
+	}
+	if e.line == 0 {
+		return fmt.Sprintf("%s: %s", e.file, e.msg)
+	}
+	if e.column == 0 {
+		return fmt.Sprintf("%s:%d: %s", e.file, e.line, e.msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.file, e.line, e.column, e.msg)
+}
+
+// configErrors are all problems found in configuration file
+type configErrors []error
+
+func (errs configErrors) Error() string {
+	lines := []string{"invalid configuration:"}
+	for _, err := range errs {
+		lines = append(lines, "  "+err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// yaml errors are "yaml: line <n>: <message>"
+var yamlErrorRegexp = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// converts syntax and type errors of yaml decoder into configErrors
+func yamlErrors(file string, err error) (errs configErrors) {
+	messages := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+	for _, msg := range messages {
+		configErr := &configError{file: file, msg: strings.TrimPrefix(msg, "yaml: ")}
+		if parsed := yamlErrorRegexp.FindStringSubmatch(msg); parsed != nil {
+			configErr.line, _ = strconv.Atoi(parsed[1])
+			configErr.msg = parsed[2]
+		}
+		errs = append(errs, configErr)
+	}
+	return
+}
+
+// validator collects all problems of configuration files
+type validator struct {
+	// file problems without position are reported in
+	file string
+	// files yaml nodes were read from, see register
+	files map[*yaml.Node]string
+	// yaml nodes by path, e.g. nodes[0].provider.box
+	nodes map[string]*yaml.Node
+	errs  configErrors
+}
+
+func newValidator(file string) *validator {
+	return &validator{file: file, files: map[*yaml.Node]string{}, nodes: map[string]*yaml.Node{}}
+}
+
+// records file of the node and all its children
+func (v *validator) register(node *yaml.Node, file string) {
+	v.files[node] = file
+	for _, child := range node.Content {
+		v.register(child, file)
+	}
+}
+
+// returns file the node was read from
+func (v *validator) fileOf(node *yaml.Node) string {
+	if file, ok := v.files[node]; ok {
+		return file
+	}
+	return v.file
+}
+
+// places new node at position of node in its file, generated nodes point to where they came from
+func (v *validator) placeAt(generated, node *yaml.Node) *yaml.Node {
+	generated.Line, generated.Column = node.Line, node.Column
+	v.files[generated] = v.fileOf(node)
+	return generated
+}
+
+// returns shallow copy of the node in the same file
+func (v *validator) copyNode(node *yaml.Node) *yaml.Node {
+	copied := *node
+	v.files[&copied] = v.fileOf(node)
+	return &copied
+}
+
+// records error at yaml node of the path, at closest parent if path is not in the file
+func (v *validator) errorf(path string, format string, args ...interface{}) {
+	for {
+		if node, ok := v.nodes[path]; ok {
+			v.errorAt(node, format, args...)
+			return
+		}
+		if path == "" {
+			v.errs = append(v.errs, &configError{file: v.file, msg: fmt.Sprintf(format, args...)})
+			return
+		}
+		if i := strings.LastIndexAny(path, ".["); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+}
+
+func (v *validator) errorAt(node *yaml.Node, format string, args ...interface{}) {
+	v.errs = append(v.errs, &configError{file: v.fileOf(node), line: node.Line, column: node.Column, msg: fmt.Sprintf(format, args...)})
+}
+
+// returns path of the key in mapping at path
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// checks keys of mappings against yaml tags of struct type t, positions of all values are recorded
+func (v *validator) walk(node *yaml.Node, t reflect.Type, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	v.nodes[path] = node
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			if path == "" {
+				path = "configuration"
+			}
+			v.errorAt(node, "%s must be mapping", path)
+			return
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			if tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; tag != "" && tag != "-" {
+				fields[tag] = t.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			// merged anchors are checked as part of the mapping
+			if key.Tag == "!!merge" {
+				merged := []*yaml.Node{value}
+				if value.Kind == yaml.SequenceNode {
+					merged = value.Content
+				}
+				for _, m := range merged {
+					v.walk(m, t, path)
+				}
+				v.nodes[path] = node
+				continue
+			}
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				v.errorAt(key, "unknown key %s", joinPath(path, key.Value))
+				continue
+			}
+			v.walk(value, fieldType, joinPath(path, key.Value))
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			v.errorAt(node, "%s must be list", path)
+			return
+		}
+		for i, item := range node.Content {
+			v.walk(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			v.errorAt(node, "%s must be mapping", path)
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.walk(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value))
+		}
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Uint32:
+		if err := node.Decode(reflect.New(t).Interface()); err != nil {
+			for _, configErr := range yamlErrors(v.fileOf(node), err) {
+				v.errorAt(node, "%s: %s", path, configErr.(*configError).msg)
+			}
+		}
+	}
+}
+
+// node names are used in paths, container names and hostnames
+var nodeNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// project name is used as state directory name
+var projectRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9-]*$`)
+
+// checks values of decoded configuration
+func (v *validator) validate(conf *configType) {
+	if len(conf.Nodes) == 0 {
+		v.errorf("nodes", "no nodes defined")
+	}
+	if conf.Project != "" && !projectRegexp.MatchString(conf.Project) {
+		v.errorf("project", "project %s may contain only letters, digits and dashes", conf.Project)
+	}
+	if conf.Defaults.Name != "" {
+		v.errorf("defaults.name", "defaults cannot set node name")
+	}
+
+	defined := map[string]string{}
+	for i := range conf.Nodes {
+		node := &conf.Nodes[i]
+		nodePath := fmt.Sprintf("nodes[%d]", i)
+
+		if node.Name == "" {
+			v.errorf(nodePath+".name", "node name is required")
+		} else if !nodeNameRegexp.MatchString(node.Name) {
+			v.errorf(nodePath+".name", "node name %s may contain only letters, digits, dots, dashes and underscores", node.Name)
+		} else if previous, ok := defined[node.Name]; ok {
+			v.errorf(nodePath+".name", "node %s is already defined at %s", node.Name, previous)
+		} else if n, ok := v.nodes[nodePath+".name"]; ok {
+			defined[node.Name] = fmt.Sprintf("%d:%d", n.Line, n.Column)
+		}
+
+		v.validateProvider(node, nodePath)
+		v.validateProvisioners(node.Provisioner, nodePath+".provisioner", false)
+
+		switch node.Verifier.Name {
+		case "":
+		case "goss":
+			if node.Verifier.GossFile == "" {
+				v.errorf(nodePath+".verifier.goss_file", "goss_file is required for goss verifier")
+			}
+		default:
+			v.errorf(nodePath+".verifier.name", "unsupported verifier %s, supported: goss", node.Verifier.Name)
+		}
+
+		for j, file := range node.Files {
+			if !path.IsAbs(file.Path) {
+				v.errorf(fmt.Sprintf("%s.files[%d].path", nodePath, j), "file path must be absolute")
+			}
+		}
+		if node.SSH.Port < 0 || node.SSH.Port > 65535 {
+			v.errorf(nodePath+".ssh.port", "invalid ssh port %d", node.SSH.Port)
+		}
+		if node.SSH.ProxyJump != "" {
+			if _, err := parseProxyJump(node.SSH.ProxyJump, "user"); err != nil {
+				v.errorf(nodePath+".ssh.proxy_jump", "%s", err)
+			}
+		}
+		for key, value := range map[string]int{"timeout": node.SSH.Timeout, "retries": node.SSH.Retries, "connect_timeout": node.SSH.ConnectTimeout} {
+			if value < 0 {
+				v.errorf(nodePath+".ssh."+key, "ssh %s must not be negative", key)
+			}
+		}
+	}
+
+	v.validateProvisioners(conf.Provisioner, "provisioner", true)
+
+	v.validateNames("platforms", len(conf.Platforms), func(i int) string { return conf.Platforms[i].Name })
+	v.validateNames("suites", len(conf.Suites), func(i int) string { return conf.Suites[i].Name })
+	if len(conf.Platforms) > 0 && len(conf.Suites) == 0 {
+		v.errorf("platforms", "platforms have no suites to be tested on them")
+	}
+	if len(conf.Suites) > 0 && len(conf.Platforms) == 0 {
+		v.errorf("suites", "suites have no platforms to be tested on")
+	}
+}
+
+// checks that names of platforms or suites are set and unique, they are parts of node names
+func (v *validator) validateNames(key string, count int, name func(i int) string) {
+	defined := map[string]bool{}
+	for i := 0; i < count; i++ {
+		namePath := fmt.Sprintf("%s[%d].name", key, i)
+		if name(i) == "" {
+			v.errorf(namePath, "name is required")
+		} else if !nodeNameRegexp.MatchString(name(i)) {
+			v.errorf(namePath, "name %s may contain only letters, digits, dots, dashes and underscores", name(i))
+		} else if defined[name(i)] {
+			v.errorf(namePath, "%s %s is defined twice", key, name(i))
+		}
+		defined[name(i)] = true
+	}
+}
+
+func (v *validator) validateProvider(node *nodeType, nodePath string) {
+	providerPath := nodePath + ".provider"
+	name := node.Provider.Name
+	if name == "" {
+		v.errorf(providerPath+".name", "provider name is required")
+	} else if _, ok := providers[name]; !ok {
+		if _, err := exec.LookPath(pluginPrefix + name); err != nil {
+			v.errorf(providerPath+".name", "unsupported provider %s and %s%s was not found in PATH", name, pluginPrefix, name)
+		}
+	}
+
+	switch name {
+	case "vagrant":
+		if node.Provider.Box == "" {
+			v.errorf(providerPath+".box", "box is required for vagrant provider")
+		}
+	case "docker", "podman", "lxd", "incus", "qemu":
+		if node.Provider.Image == "" {
+			v.errorf(providerPath+".image", "image is required for %s provider", name)
+		}
+	case "nspawn":
+		if node.Provider.Image == "" && node.Provider.Box == "" {
+			v.errorf(providerPath, "image or box is required for nspawn provider")
+		}
+	case "static":
+		if node.SSH.Host == "" {
+			v.errorf(nodePath+".ssh.host", "ssh host is required for static provider")
+		}
+	}
+
+	for i, folder := range node.Provider.SyncedFolders {
+		dirs := strings.Split(folder, ":")
+		if len(dirs) != 2 || dirs[0] == "" || !path.IsAbs(dirs[1]) {
+			v.errorf(fmt.Sprintf("%s.synced_folders[%d]", providerPath, i), "synced folder %s must be <host dir>:<absolute vm dir>", folder)
+		}
+	}
+
+	if node.Provider.Cpus < 0 {
+		v.errorf(providerPath+".cpus", "invalid number of cpus %d", node.Provider.Cpus)
+	}
+	if node.Provider.Memory < 0 {
+		v.errorf(providerPath+".memory", "invalid memory %d", node.Provider.Memory)
+	}
+	disks := map[string]bool{}
+	for i, disk := range node.Provider.Disks {
+		diskPath := fmt.Sprintf("%s.disks[%d]", providerPath, i)
+		if disk.Name == "" {
+			v.errorf(diskPath+".name", "disk name is required")
+		} else if disks[disk.Name] {
+			v.errorf(diskPath+".name", "disk %s is already defined", disk.Name)
+		}
+		disks[disk.Name] = true
+		if !diskSizeRegexp.MatchString(disk.Size) {
+			v.errorf(diskPath+".size", "disk size %s must be number followed by MB, GB or TB, e.g. 20GB", disk.Size)
+		}
+	}
+	for name, customize := range node.Provider.Customize {
+		for key := range customize {
+			if !rubyNameRegexp.MatchString(key) {
+				v.errorf(joinPath(providerPath+".customize."+name, key), "%s is not valid %s provider setting name", key, name)
+			}
+		}
+	}
+
+	for i, network := range node.Provider.Network.PrivateNetwork {
+		if network.IP != "" && net.ParseIP(network.IP) == nil {
+			v.errorf(fmt.Sprintf("%s.network.private_network[%d].ip", providerPath, i), "invalid ip address %s", network.IP)
+		}
+	}
+	for i, network := range node.Provider.Network.PublicNetwork {
+		if network.IP != "" && net.ParseIP(network.IP) == nil {
+			v.errorf(fmt.Sprintf("%s.network.public_network[%d].ip", providerPath, i), "invalid ip address %s", network.IP)
+		}
+	}
+
+	for i, port := range node.Provider.Network.ForwardedPort {
+		if !validForwardedPort(port) {
+			v.errorf(fmt.Sprintf("%s.network.forwarded_port[%d]", providerPath, i),
+				"forwarded port %s must be <host port>:<vm port>:<protocol> or <host ip>:<host port>:<vm ip>:<vm port>:<protocol>", port)
+		}
+	}
+}
+
+var (
+	diskSizeRegexp = regexp.MustCompile(`^[1-9][0-9]*[MGT]B$`)
+	rubyNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+)
+
+// checks <host>:<guest>:<protocol> or <host_ip>:<host>:<guest_ip>:<guest>:<protocol>
+func validForwardedPort(port string) bool {
+	list := strings.Split(port, ":")
+	var ports []string
+	switch len(list) {
+	case 3:
+		ports = list[:2]
+	case 5:
+		ports = []string{list[1], list[3]}
+		if list[0] == "" || list[2] == "" {
+			return false
+		}
+	default:
+		return false
+	}
+	for _, p := range ports {
+		if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+			return false
+		}
+	}
+	protocol := list[len(list)-1]
+	return protocol == "tcp" || protocol == "udp"
+}
+
+// validates provisioners of a node or top level ones, ids identify them in state so they must be unique
+func (v *validator) validateProvisioners(provisioners []Provisioner, provisionersPath string, topLevel bool) {
+	ids := map[string]bool{}
+	for i, provisioner := range provisioners {
+		provisionerPath := fmt.Sprintf("%s[%d]", provisionersPath, i)
+		v.validateProvisioner(provisioner, provisionerPath, topLevel)
+		if provisioner.ID != "" && ids[provisioner.ID] {
+			v.errorf(provisionerPath+".id", "provisioner id %s is already defined", provisioner.ID)
+		}
+		ids[provisioner.ID] = true
+	}
+}
+
+func (v *validator) validateProvisioner(provisioner Provisioner, provisionerPath string, topLevel bool) {
+	switch provisioner.Name {
+	case "ansible":
+		if provisioner.Playbook == "" {
+			v.errorf(provisionerPath+".playbook", "playbook is required for ansible provisioner")
+		}
+	case "ansible-local", "shell":
+		if topLevel {
+			v.errorf(provisionerPath+".name", "unsupported top level provisioner %s, only ansible can run against all nodes", provisioner.Name)
+		} else if provisioner.Name == "shell" && provisioner.Content == "" {
+			v.errorf(provisionerPath+".content", "content is required for shell provisioner")
+		}
+	case "":
+		v.errorf(provisionerPath+".name", "provisioner name is required")
+	default:
+		v.errorf(provisionerPath+".name", "unsupported provisioner %s, supported: ansible, ansible-local, shell", provisioner.Name)
+	}
+}
+
+// decodes merged configuration, returns all problems found as configErrors
+func (v *validator) decode(root *yaml.Node, conf *configType) error {
+	interpolate(v, root)
+	v.walk(root, reflect.TypeOf(*conf), "")
+	expandMatrix(v, root)
+	resolveNodes(v, root)
+
+	// positions of generated and merged nodes, their unknown keys were reported where they are defined
+	errs := v.errs
+	v.walk(root, reflect.TypeOf(*conf), "")
+	v.errs = errs
+
+	// type errors are reported by walk with their files, decoder knows only lines
+	if err := root.Decode(conf); err != nil && len(v.errs) == 0 {
+		v.errs = append(v.errs, yamlErrors(v.file, err)...)
+	}
+	v.validate(conf)
+
+	if len(v.errs) > 0 {
+		return v.sortedErrors()
+	}
+	return nil
+}
+
+// returns errors ordered by position, errors of platforms and suites are reported once
+// even though they are part of many generated nodes
+func (v *validator) sortedErrors() (errs configErrors) {
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		a, b := v.errs[i].(*configError), v.errs[j].(*configError)
+		if a.file != b.file {
+			return a.file < b.file
+		}
+		return a.line < b.line || (a.line == b.line && a.column < b.column)
+	})
+	for i, err := range v.errs {
+		if i == 0 || *err.(*configError) != *v.errs[i-1].(*configError) {
+			errs = append(errs, err)
+		}
+	}
+	return
+}
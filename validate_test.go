@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		errs   []string
+	}{
+		{
+			name: "valid",
+			config: `
+project: demo
+nodes:
+  - name: web
+    provider: {name: docker, image: nginx}
+    provisioner:
+      - {name: shell, content: hostname, id: hostname}
+`,
+		},
+		{
+			name: "node names",
+			config: `
+nodes:
+  - name: web
+    provider: {name: docker, image: nginx}
+  - name: web
+    provider: {name: docker, image: nginx}
+  - name: -db
+    provider: {name: docker, image: postgres}
+`,
+			errs: []string{
+				"clover.yml:5:11: node web is already defined at 3:11",
+				"clover.yml:7:11: node name -db may contain only letters, digits, dots, dashes and underscores",
+			},
+		},
+		{
+			name: "project name",
+			config: `
+project: my_project
+nodes:
+  - name: web
+    provider: {name: docker, image: nginx}
+`,
+			errs: []string{"clover.yml:2:10: project my_project may contain only letters, digits and dashes"},
+		},
+		{
+			name: "provider settings",
+			config: `
+nodes:
+  - name: web
+    provider: {name: docker}
+  - name: vm
+    provider:
+      name: vagrant
+      box: debian/bookworm64
+      cpus: -1
+      disks:
+        - {name: data, size: 10}
+        - {name: data, size: 10GB}
+  - name: host
+    provider: {name: static}
+`,
+			errs: []string{
+				"clover.yml:4:15: image is required for docker provider",
+				"clover.yml:9:13: invalid number of cpus -1",
+				"clover.yml:11:30: disk size 10 must be number followed by MB, GB or TB, e.g. 20GB",
+				"clover.yml:12:18: disk data is already defined",
+				"clover.yml:13:5: ssh host is required for static provider",
+			},
+		},
+		{
+			name: "ssh settings",
+			config: `
+nodes:
+  - name: host
+    provider: {name: static}
+    ssh:
+      host: 10.0.0.1
+      proxy_jump: "user@bastion:port"
+      timeout: -5
+`,
+			errs: []string{
+				"clover.yml:7:19: invalid port of proxy jump user@bastion:port",
+				"clover.yml:8:16: ssh timeout must not be negative",
+			},
+		},
+		{
+			name: "provisioners",
+			config: `
+nodes:
+  - name: web
+    provider: {name: docker, image: nginx}
+    provisioner:
+      - {name: shell, id: setup}
+      - {name: ansible, id: setup}
+      - {name: puppet}
+provisioner:
+  - {name: shell, content: hostname}
+`,
+			errs: []string{
+				"clover.yml:6:9: content is required for shell provisioner",
+				"clover.yml:7:9: playbook is required for ansible provisioner",
+				"clover.yml:7:29: provisioner id setup is already defined",
+				"clover.yml:8:16: unsupported provisioner puppet, supported: ansible, ansible-local, shell",
+				"clover.yml:10:12: unsupported top level provisioner shell, only ansible can run against all nodes",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, map[string]string{"clover.yml": test.config}, []string{"clover.yml"})
+			if len(test.errs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected errors")
+			}
+			expected := strings.Join(append([]string{"invalid configuration:"}, test.errs...), "\n  ")
+			if err.Error() != expected {
+				t.Errorf("errors\n%s\nexpected\n%s", err, expected)
+			}
+		})
+	}
+}
@@ -2,14 +2,36 @@ package main
 
 import "fmt"
 
-func (node *nodeType) verify(vagrantDir string) (err error) {
+// runs verifier of the node, node without verifier is not verified and its state is kept
+func (node *nodeType) verify(p *project) (err error) {
+	if node.Verifier.Name == "" {
+		fmt.Fprintln(node.outWriter(), "No verifier defined for node", node.Name)
+		return
+	}
+
+	defer func() {
+		if stateErr := p.recordRun(node, "verify", err); err == nil {
+			err = stateErr
+		}
+	}()
+
+	provider, err := p.provider(node)
+	if err != nil {
+		return
+	}
+
 	if node.Verifier.Name == `goss` {
-		err = node.sshCommand(vagrantDir, fmt.Sprintf("sudo /usr/bin/goss --gossfile %s validate", node.Verifier.GossFile), true)
+		transport, err := p.transport(node)
+		if err != nil {
+			return err
+		}
+
+		err = transport.Run(fmt.Sprintf("/usr/bin/goss --gossfile %s validate", node.Verifier.GossFile), node.outWriter(), node.errWriter())
 		if err != nil {
-			return
+			return err
 		}
 	} else {
-		err = fmt.Errorf("Unsupported verifier %s for node %s", node.Verifier.Name, node.Name)
+		return fmt.Errorf("Unsupported verifier %s for node %s", node.Verifier.Name, node.Name)
 	}
-	return
+	return p.recordStage(node, provider, stageVerified)
 }